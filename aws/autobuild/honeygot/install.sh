@@ -7,9 +7,14 @@ if [ -f ${MYCONF} ]; then
         source ${MYCONF}
 fi
 
-# throw away output and run in background
-#$(dirname ${0})/honeygot-linux64 -httpport 80 -mysqlport 3306 -sshport 22 -batcher-bucket ${BATCHER_S3_BUCKET} > /dev/null 2>&1 &
-$(dirname ${0})/honeygot-linux64 -sshport 22 -batcher-bucket ${BATCHER_S3_BUCKET} > /dev/null 2>&1 &
+# throw away output and run in background. If a config file is shipped with
+# this sensor then it describes all listeners and the sink
+if [ -n "${HONEYGOT_CONFIG}" ] && [ -f "${HONEYGOT_CONFIG}" ]; then
+    $(dirname ${0})/honeygot-linux64 -config ${HONEYGOT_CONFIG} > /dev/null 2>&1 &
+else
+    #$(dirname ${0})/honeygot-linux64 -httpport 80 -mysqlport 3306 -sshport 22 -batcher-bucket ${BATCHER_S3_BUCKET} > /dev/null 2>&1 &
+    $(dirname ${0})/honeygot-linux64 -sshport 22 -batcher-bucket ${BATCHER_S3_BUCKET} > /dev/null 2>&1 &
+fi
 
 # add a message that will appear in the AWS console output
 /usr/bin/logger "autobuild: honeygot installed and started"
@@ -0,0 +1,353 @@
+// Package events holds the honeygot event types shared by the sensor, the report
+// tool and anything else that reads honeygot batches
+package events
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// event schema versions
+const (
+	SchemaV1 = "v1" // original flat event with free text TypeData
+	SchemaV2 = "v2" // typed event with ports, transport and structured details
+)
+
+type AuthEvent struct {
+	Time        string // number of seconds from Unix epoch
+	AuthType    string // type of event - eg sshPass, sshKey
+	SrcIP       string //
+	DestIP      string //
+	User        string // username used
+	Credentials string // ssh password or ssh key used
+	TypeData    string // extra data specific to the auth type. May be json and/or base64 encoded
+	Hash        string // mostly uniq hash of the event
+	SessionID   string `json:",omitempty"` // connection the event happened on
+	HASSH       string `json:",omitempty"` // fingerprint of the ssh client's KEXINIT
+
+	// added by the batcher to say where the event was captured
+	Sensor     string            `json:",omitempty"` // configured sensor id
+	InstanceID string            `json:",omitempty"` // ec2 instance id
+	Region     string            `json:",omitempty"` // ec2 region
+	AZ         string            `json:",omitempty"` // ec2 availability zone
+	AMI        string            `json:",omitempty"` // ec2 image id
+	Tags       map[string]string `json:",omitempty"` // configured sensor tags
+
+	// added from the geoip databases for the source address
+	Country string `json:",omitempty"` // ISO 3166 country code
+	City    string `json:",omitempty"` // english city name
+	ASN     uint   `json:",omitempty"` // autonomous system number
+	ASOrg   string `json:",omitempty"` // autonomous system organisation
+
+	SrcHost string `json:",omitempty"` // reverse dns name of the source address
+
+	// only sent in the v2 schema
+	At        time.Time   `json:"-"` // when the event happened
+	Protocol  string      `json:"-"` // listener protocol - eg ssh
+	Transport string      `json:"-"` // eg tcp
+	SrcPort   int         `json:"-"` //
+	DestPort  int         `json:"-"` //
+	Details   interface{} `json:"-"` // protocol specific details - eg *SSHDetails. json.RawMessage once parsed
+}
+
+// SSHDetails are the v2 details of ssh events
+type SSHDetails struct {
+	ClientVersion string         `json:"clientVersion"`
+	KexInit       *KexInit       `json:"kexInit,omitempty"`
+	KeyType       string         `json:"keyType,omitempty"`
+	PublicKey     string         `json:"publicKey,omitempty"`   // offered key as an authorized_keys line
+	Fingerprint   string         `json:"fingerprint,omitempty"` // openssh SHA256: fingerprint of the key
+	KeyBits       int            `json:"keyBits,omitempty"`
+	Cert          *SSHCert       `json:"cert,omitempty"`    // set when the key is a certificate
+	Prompts       []PromptAnswer `json:"prompts,omitempty"` // keyboard-interactive exchange so far
+}
+
+// SSHCert is what an offered ssh certificate says about itself. The times are RFC3339
+// or forever
+type SSHCert struct {
+	Type          string   `json:"type"` // user or host
+	KeyID         string   `json:"keyId"`
+	Serial        uint64   `json:"serial"`
+	Principals    []string `json:"principals"`
+	ValidAfter    string   `json:"validAfter"`
+	ValidBefore   string   `json:"validBefore"`
+	CAKeyType     string   `json:"caKeyType"`
+	CAFingerprint string   `json:"caFingerprint"`
+}
+
+// PromptAnswer is a keyboard-interactive prompt and the client's answer
+type PromptAnswer struct {
+	Prompt string `json:"prompt"`
+	Answer string `json:"answer"`
+}
+
+// SSHSummaryDetails are the v2 details of the sshSummary event sent when an ssh connection ends
+type SSHSummaryDetails struct {
+	ClientVersion string           `json:"clientVersion"`
+	KexInit       *KexInit         `json:"kexInit,omitempty"`
+	Attempts      []SSHAuthAttempt `json:"attempts"`        // every auth attempt in the order the client made them
+	Methods       map[string]int   `json:"methods"`         // attempts with each method
+	Duration      float64          `json:"duration"`        // seconds the connection was open
+	Error         string           `json:"error,omitempty"` // handshake error
+}
+
+// KexInit is the algorithms an ssh client offered in its KEXINIT in its order of preference.
+// The ciphers, macs and compression are the client to server lists
+type KexInit struct {
+	Kex         []string `json:"kex"`
+	HostKey     []string `json:"hostKey"`
+	Ciphers     []string `json:"ciphers"`
+	MACs        []string `json:"macs"`
+	Compression []string `json:"compression"`
+}
+
+// SSHAuthAttempt is one auth method tried by an ssh client
+type SSHAuthAttempt struct {
+	Method string `json:"method"`
+	User   string `json:"user"`
+}
+
+// MySQLDetails are the v2 details of mysql events
+type MySQLDetails struct {
+	Salt     string `json:"salt"` // hex encoded auth salt sent to the client
+	Database string `json:"database"`
+	Error    string `json:"error,omitempty"`
+}
+
+// HTTPDetails are the v2 details of http events
+type HTTPDetails struct {
+	Method    string `json:"method"`
+	Host      string `json:"host"`
+	Path      string `json:"path"`
+	UserAgent string `json:"userAgent"`
+}
+
+// SessionDetails are the v2 details of disconnect events
+type SessionDetails struct {
+	Duration float64 `json:"duration"` // seconds the connection was open
+	BytesIn  int64   `json:"bytesIn"`
+	BytesOut int64   `json:"bytesOut"`
+	Reason   string  `json:"reason"` // why the connection closed
+}
+
+// QueueDropDetails are the v2 details of queueDrop events
+type QueueDropDetails struct {
+	Dropped  uint64 `json:"dropped"`
+	Capacity int    `json:"capacity"`
+	Policy   string `json:"policy"`
+}
+
+// authEventV2 is the v2 json form of an event
+type authEventV2 struct {
+	Schema      string            `json:"schema"`
+	Time        string            `json:"time"` // RFC3339 with nanoseconds
+	Type        string            `json:"type"`
+	Protocol    string            `json:"protocol,omitempty"`
+	Transport   string            `json:"transport,omitempty"`
+	SrcIP       string            `json:"srcIp"`
+	SrcPort     int               `json:"srcPort,omitempty"`
+	DestIP      string            `json:"destIp"`
+	DestPort    int               `json:"destPort,omitempty"`
+	User        string            `json:"user"`
+	Credentials string            `json:"credentials"`
+	SessionID   string            `json:"sessionId,omitempty"`
+	HASSH       string            `json:"hassh,omitempty"`
+	Details     interface{}       `json:"details,omitempty"`
+	Hash        string            `json:"hash"`
+	Sensor      string            `json:"sensor,omitempty"`
+	InstanceID  string            `json:"instanceId,omitempty"`
+	Region      string            `json:"region,omitempty"`
+	AZ          string            `json:"az,omitempty"`
+	AMI         string            `json:"ami,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Country     string            `json:"country,omitempty"`
+	City        string            `json:"city,omitempty"`
+	ASN         uint              `json:"asn,omitempty"`
+	ASOrg       string            `json:"asOrg,omitempty"`
+	SrcHost     string            `json:"srcHost,omitempty"`
+}
+
+// New creates an event happening now on a connection from remote to local.
+// Either address may be nil
+func New(authType, protocol string, remote, local net.Addr) *AuthEvent {
+
+	now := time.Now()
+	ae := &AuthEvent{
+		Time:     fmt.Sprintf("%d", now.Unix()),
+		At:       now,
+		AuthType: authType,
+		Protocol: protocol,
+	}
+	if remote != nil {
+		ae.Transport = remote.Network()
+		ae.SrcIP, ae.SrcPort = splitAddr(remote.String())
+	}
+	if local != nil {
+		_, ae.DestPort = splitAddr(local.String())
+	}
+	return ae
+}
+
+// splitAddr splits a host:port address. The port is 0 if there is none. Any ipv6 zone
+// is dropped so the host is a plain ip address
+func splitAddr(addr string) (string, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+// UpdateHash sets the hash used to spot the same event being stored twice
+func (ae *AuthEvent) UpdateHash() {
+	h := sha256.New()
+	h.Write([]byte(fmt.Sprintf("%s%s%s%s%s%s%v", ae.Time, ae.AuthType, ae.SrcIP, ae.DestIP, ae.User, ae.Credentials, ae.TypeData)))
+	ae.Hash = base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Encode returns the event as json in the requested schema
+func (ae *AuthEvent) Encode(schema string) ([]byte, error) {
+
+	if schema != SchemaV2 {
+		return json.Marshal(ae)
+	}
+
+	at := ae.At
+	if at.IsZero() {
+		// v1 events only know the second they happened
+		sec, _ := strconv.ParseInt(ae.Time, 10, 64)
+		at = time.Unix(sec, 0)
+	}
+
+	return json.Marshal(&authEventV2{
+		Schema:      SchemaV2,
+		Time:        at.UTC().Format(time.RFC3339Nano),
+		Type:        ae.AuthType,
+		Protocol:    ae.Protocol,
+		Transport:   ae.Transport,
+		SrcIP:       ae.SrcIP,
+		SrcPort:     ae.SrcPort,
+		DestIP:      ae.DestIP,
+		DestPort:    ae.DestPort,
+		User:        ae.User,
+		Credentials: ae.Credentials,
+		SessionID:   ae.SessionID,
+		HASSH:       ae.HASSH,
+		Details:     ae.Details,
+		Hash:        ae.Hash,
+		Sensor:      ae.Sensor,
+		InstanceID:  ae.InstanceID,
+		Region:      ae.Region,
+		AZ:          ae.AZ,
+		AMI:         ae.AMI,
+		Tags:        ae.Tags,
+		Country:     ae.Country,
+		City:        ae.City,
+		ASN:         ae.ASN,
+		ASOrg:       ae.ASOrg,
+		SrcHost:     ae.SrcHost,
+	})
+}
+
+// Parse decodes a json event line in either the v1 or v2 schema. The details of
+// v2 events are left as json.RawMessage
+func Parse(line []byte) (*AuthEvent, error) {
+
+	v2 := &authEventV2{}
+	if err := json.Unmarshal(line, v2); err != nil {
+		return nil, err
+	}
+
+	switch v2.Schema {
+	case "":
+		// v1 events have no schema field
+		ae := &AuthEvent{}
+		if err := json.Unmarshal(line, ae); err != nil {
+			return nil, err
+		}
+		return ae, nil
+	case SchemaV2:
+		at, err := time.Parse(time.RFC3339Nano, v2.Time)
+		if err != nil {
+			return nil, err
+		}
+		ae := &AuthEvent{
+			Time:        fmt.Sprintf("%d", at.Unix()),
+			At:          at,
+			AuthType:    v2.Type,
+			Protocol:    v2.Protocol,
+			Transport:   v2.Transport,
+			SrcIP:       v2.SrcIP,
+			SrcPort:     v2.SrcPort,
+			DestIP:      v2.DestIP,
+			DestPort:    v2.DestPort,
+			User:        v2.User,
+			Credentials: v2.Credentials,
+			SessionID:   v2.SessionID,
+			HASSH:       v2.HASSH,
+			Hash:        v2.Hash,
+			Sensor:      v2.Sensor,
+			InstanceID:  v2.InstanceID,
+			Region:      v2.Region,
+			AZ:          v2.AZ,
+			AMI:         v2.AMI,
+			Tags:        v2.Tags,
+			Country:     v2.Country,
+			City:        v2.City,
+			ASN:         v2.ASN,
+			ASOrg:       v2.ASOrg,
+			SrcHost:     v2.SrcHost,
+		}
+		// decode the details again to keep them raw
+		var raw struct {
+			Details json.RawMessage `json:"details"`
+		}
+		if err := json.Unmarshal(line, &raw); err == nil && len(raw.Details) > 0 {
+			ae.Details = raw.Details
+		}
+		return ae, nil
+	}
+	return nil, fmt.Errorf("unknown event schema %q", v2.Schema)
+}
+
+// Validate checks the event has everything a reader relies on and returns an error
+// describing every problem found
+func (ae *AuthEvent) Validate() error {
+
+	var errs []string
+
+	if ae.AuthType == "" {
+		errs = append(errs, "no auth type")
+	}
+	if _, err := strconv.ParseInt(ae.Time, 10, 64); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid time %q", ae.Time))
+	}
+	if ae.SrcIP != "" && net.ParseIP(ae.SrcIP) == nil {
+		errs = append(errs, fmt.Sprintf("invalid source ip %q", ae.SrcIP))
+	}
+	if ae.DestIP != "" && net.ParseIP(ae.DestIP) == nil {
+		errs = append(errs, fmt.Sprintf("invalid destination ip %q", ae.DestIP))
+	}
+	if ae.SrcPort < 0 || ae.SrcPort > 65535 || ae.DestPort < 0 || ae.DestPort > 65535 {
+		errs = append(errs, "invalid port")
+	}
+	if ae.Hash == "" {
+		errs = append(errs, "no hash")
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package events
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthEventEncode(t *testing.T) {
+
+	remote := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 51234}
+	local := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	ae := New("sshPass", "ssh", remote, local)
+	ae.At = time.Date(2016, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	ae.Time = "1451703845"
+	ae.User = "root"
+	ae.Credentials = `"123456"`
+	ae.TypeData = `client-version: "SSH-2.0-Go"`
+	ae.Details = &SSHDetails{ClientVersion: "SSH-2.0-Go"}
+	ae.UpdateHash()
+
+	// v1 stays exactly as it was
+	v1, err := ae.Encode(SchemaV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"SrcPort", "Details", "schema", "Protocol"} {
+		if strings.Contains(string(v1), s) {
+			t.Errorf("v1 event contains %s: %s", s, v1)
+		}
+	}
+
+	v2, err := ae.Encode(SchemaV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(v2, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"schema":    "v2",
+		"time":      "2016-01-02T03:04:05.123456789Z",
+		"type":      "sshPass",
+		"protocol":  "ssh",
+		"transport": "tcp",
+		"srcIp":     "198.51.100.7",
+		"srcPort":   float64(51234),
+		"destPort":  float64(22),
+		"user":      "root",
+		"hash":      ae.Hash,
+	}
+	for k, w := range want {
+		if got[k] != w {
+			t.Errorf("%s: expected %v, got %v", k, w, got[k])
+		}
+	}
+	if d, ok := got["details"].(map[string]interface{}); !ok || d["clientVersion"] != "SSH-2.0-Go" {
+		t.Errorf("unexpected details %v", got["details"])
+	}
+}
+
+func TestSplitAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		host string
+		port int
+	}{
+		{"1.2.3.4:22", "1.2.3.4", 22},
+		{"[2001:db8::1]:3306", "2001:db8::1", 3306},
+		{"[fe80::1%eth0]:22", "fe80::1", 22},
+		{"1.2.3.4", "1.2.3.4", 0},
+	}
+	for _, tt := range tests {
+		if h, p := splitAddr(tt.addr); h != tt.host || p != tt.port {
+			t.Errorf("%s: expected %s %d, got %s %d", tt.addr, tt.host, tt.port, h, p)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+
+	ae := New("sshKey", "ssh", &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 5555}, nil)
+	ae.User = "root"
+	ae.SessionID = "3f2c"
+	ae.HASSH = "ec7378c1a92f5a8dde7e8b7a1ddf33d1"
+	ae.Country, ae.ASN = "AU", 64500
+	ae.Details = &SSHDetails{ClientVersion: "SSH-2.0-Go", KeyType: "ssh-rsa"}
+	ae.UpdateHash()
+
+	for _, schema := range []string{SchemaV1, SchemaV2} {
+		line, err := ae.Encode(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Parse(line)
+		if err != nil {
+			t.Fatalf("%s: %v", schema, err)
+		}
+		if got.Time != ae.Time || got.AuthType != ae.AuthType || got.SrcIP != ae.SrcIP || got.User != ae.User || got.Hash != ae.Hash || got.SessionID != ae.SessionID || got.HASSH != ae.HASSH || got.Country != ae.Country || got.ASN != ae.ASN {
+			t.Errorf("%s: expected %+v, got %+v", schema, ae, got)
+		}
+		if err := got.Validate(); err != nil {
+			t.Errorf("%s: unexpected validate error: %v", schema, err)
+		}
+		if schema == SchemaV2 {
+			if got.SrcPort != 5555 || !got.At.Equal(ae.At) {
+				t.Errorf("v2 fields lost: %+v", got)
+			}
+			if d, ok := got.Details.(json.RawMessage); !ok || !strings.Contains(string(d), "ssh-rsa") {
+				t.Errorf("details lost: %v", got.Details)
+			}
+		}
+	}
+
+	// lines written before the events package existed
+	got, err := Parse([]byte(`{"Time":"1451703845","AuthType":"sshPass","SrcIP":"1.2.3.4","DestIP":"","User":"admin","Credentials":"\"admin\"","TypeData":"","Hash":"abc"}`))
+	if err != nil || got.User != "admin" || got.Time != "1451703845" {
+		t.Errorf("v1 line not parsed: %+v %v", got, err)
+	}
+
+	if _, err := Parse([]byte(`{"schema":"v9"}`)); err == nil {
+		t.Error("expected an error for an unknown schema")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ae := &AuthEvent{Time: "soon", SrcIP: "nowhere", DestPort: 70000}
+	err := ae.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, e := range []string{"no auth type", `invalid time "soon"`, `invalid source ip "nowhere"`, "invalid port", "no hash"} {
+		if !strings.Contains(err.Error(), e) {
+			t.Errorf("error %q does not contain %q", err, e)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package geoip
+
+import (
+	"net"
+)
+
+// Location is what the databases know about an address
+type Location struct {
+	Country string // ISO 3166 country code
+	City    string // english city name
+	ASN     uint   // autonomous system number
+	ASOrg   string // organisation the autonomous system is registered to
+}
+
+// DB looks addresses up in a set of country, city and ASN databases
+type DB struct {
+	readers []*Reader
+}
+
+// OpenDB opens every database in paths. Any mix of country, city and ASN databases
+// can be used and the first one holding a value wins
+func OpenDB(paths []string) (*DB, error) {
+	db := &DB{}
+	for _, p := range paths {
+		r, err := Open(p)
+		if err != nil {
+			return nil, err
+		}
+		db.readers = append(db.readers, r)
+	}
+	return db, nil
+}
+
+// Types returns the database type of each open database
+func (db *DB) Types() []string {
+	var t []string
+	for _, r := range db.readers {
+		t = append(t, r.Type)
+	}
+	return t
+}
+
+// Lookup returns the location of addr. Addresses the databases do not hold, and any
+// database errors, leave the fields empty
+func (db *DB) Lookup(addr string) Location {
+
+	var loc Location
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return loc
+	}
+
+	for _, r := range db.readers {
+		m, err := r.Lookup(ip)
+		if err != nil || m == nil {
+			continue
+		}
+		if loc.Country == "" {
+			loc.Country = field(m, "country", "iso_code")
+		}
+		if loc.Country == "" {
+			// anycast and satellite ranges only have the registered country
+			loc.Country = field(m, "registered_country", "iso_code")
+		}
+		if loc.City == "" {
+			loc.City = field(m, "city", "names", "en")
+		}
+		if loc.ASN == 0 {
+			loc.ASN = uint(toUint(m["autonomous_system_number"]))
+		}
+		if loc.ASOrg == "" {
+			loc.ASOrg = field(m, "autonomous_system_organization")
+		}
+	}
+	return loc
+}
+
+// field returns the string found by following path through nested maps
+func field(m map[string]interface{}, path ...string) string {
+	var v interface{} = m
+	for _, k := range path {
+		mm, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = mm[k]
+	}
+	s, _ := v.(string)
+	return s
+}
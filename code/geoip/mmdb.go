@@ -0,0 +1,355 @@
+// Package geoip looks addresses up in MaxMind format .mmdb country, city and ASN
+// databases read from disk, so honeygot events can be enriched without any network access
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// metadataMarker comes just before the metadata map at the end of every database
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var errCorrupt = errors.New("database is corrupt")
+
+// data section field types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEnd
+	typeBool
+	typeFloat
+)
+
+// maxDepth limits how deeply nested the data can be so a bad file can not loop forever
+const maxDepth = 64
+
+// Reader reads a single .mmdb database held in memory
+type Reader struct {
+	Type string // database_type from the metadata - eg GeoLite2-ASN
+
+	tree       []byte // binary search tree
+	data       []byte // data section the tree points into
+	nodeCount  uint
+	recordSize uint // bits in each of the two records of a node
+	ipVersion  uint
+	ipv4Start  uint // node ipv4 lookups start from in an ipv6 tree
+}
+
+// Open reads the database at path
+func Open(path string) (*Reader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := FromBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return r, nil
+}
+
+// FromBytes reads a database from buf
+func FromBytes(buf []byte) (*Reader, error) {
+
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind database")
+	}
+
+	d := decoder{buf: buf[i+len(metadataMarker):]}
+	v, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %v", err)
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+
+	r := &Reader{
+		nodeCount:  uint(toUint(meta["node_count"])),
+		recordSize: uint(toUint(meta["record_size"])),
+		ipVersion:  uint(toUint(meta["ip_version"])),
+	}
+	r.Type, _ = meta["database_type"].(string)
+
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported ip version %d", r.ipVersion)
+	}
+
+	// the tree is followed by 16 zero bytes then the data section
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errCorrupt
+	}
+	r.tree = buf[:treeSize]
+	r.data = buf[treeSize+16 : i]
+
+	// ipv4 addresses live under ::/96 in an ipv6 tree
+	if r.ipVersion == 6 {
+		for n := 0; n < 96 && r.ipv4Start < r.nodeCount; n++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node
+func (r *Reader) record(node, bit uint) uint {
+
+	b := r.tree[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		// the middle byte holds the top 4 bits of both records
+		if bit == 0 {
+			return (uint(b[3])&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return (uint(b[3])&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// Lookup returns the data held for ip, or nil if the database has nothing for it
+func (r *Reader) Lookup(ip net.IP) (map[string]interface{}, error) {
+
+	bits := ip.To4()
+	node := uint(0)
+	if bits != nil {
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else {
+		if bits = ip.To16(); bits == nil {
+			return nil, fmt.Errorf("invalid ip address %v", ip)
+		}
+		if r.ipVersion == 4 {
+			return nil, nil
+		}
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(bits[i/8]>>(7-uint(i%8)))&1)
+	}
+
+	switch {
+	case node == r.nodeCount:
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, errCorrupt
+	}
+
+	d := decoder{buf: r.data}
+	v, _, err := d.decode(node-r.nodeCount-16, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := v.(map[string]interface{})
+	return m, nil
+}
+
+// decoder reads values from a data section. Pointers are offsets into buf
+type decoder struct {
+	buf []byte
+}
+
+// decode returns the value at off and the offset just after it
+func (d *decoder) decode(off uint, depth int) (interface{}, uint, error) {
+
+	if depth > maxDepth {
+		return nil, 0, errCorrupt
+	}
+
+	typ, size, off, err := d.control(off)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typ == typePointer {
+		p, next, err := d.pointer(size, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(p, depth+1)
+		return v, next, err
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for n := uint(0); n < size; n++ {
+			var k, v interface{}
+			if k, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errCorrupt
+			}
+			if v, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for n := uint(0); n < size; n++ {
+			var v interface{}
+			if v, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, off, nil
+	case typeBool:
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(d.buf)) {
+		return nil, 0, errCorrupt
+	}
+	b := d.buf[off : off+size]
+	off += size
+
+	switch typ {
+	case typeString:
+		return string(b), off, nil
+	case typeBytes:
+		return append([]byte(nil), b...), off, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), off, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, errCorrupt
+		}
+		return bigEndian(b), off, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errCorrupt
+		}
+		return int32(uint32(bigEndian(b))), off, nil
+	case typeUint128:
+		// too big for a uint64 and not used by the databases we read
+		return append([]byte(nil), b...), off, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
+
+// control reads the control byte at off and returns the type and size of the value
+// and the offset of its payload
+func (d *decoder) control(off uint) (uint, uint, uint, error) {
+
+	if off >= uint(len(d.buf)) {
+		return 0, 0, 0, errCorrupt
+	}
+	c := d.buf[off]
+	off++
+
+	typ := uint(c >> 5)
+	if typ == typeExtended {
+		if off >= uint(len(d.buf)) {
+			return 0, 0, 0, errCorrupt
+		}
+		typ = 7 + uint(d.buf[off])
+		off++
+	}
+
+	// pointers use the size bits for their own encoding
+	size := uint(c & 0x1f)
+	if typ == typePointer || size < 29 {
+		return typ, size, off, nil
+	}
+
+	n := size - 28
+	if off+n > uint(len(d.buf)) {
+		return 0, 0, 0, errCorrupt
+	}
+	v := uint(bigEndian(d.buf[off : off+n]))
+	off += n
+	switch size {
+	case 29:
+		size = 29 + v
+	case 30:
+		size = 285 + v
+	default:
+		size = 65821 + v
+	}
+	return typ, size, off, nil
+}
+
+// pointer decodes a pointer whose control byte size bits were bits
+func (d *decoder) pointer(bits, off uint) (uint, uint, error) {
+
+	n := (bits>>3)&3 + 1
+	if off+n > uint(len(d.buf)) {
+		return 0, 0, errCorrupt
+	}
+	v := uint(bigEndian(d.buf[off : off+n]))
+	high := bits & 7
+
+	switch n {
+	case 1:
+		v |= high << 8
+	case 2:
+		v = (v | high<<16) + 2048
+	case 3:
+		v = (v | high<<24) + 526336
+	}
+	return v, off + n, nil
+}
+
+// bigEndian returns the unsigned value of up to 8 bytes
+func bigEndian(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// toUint returns a decoded number as a uint64. Anything else is 0
+func toUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int32:
+		if n > 0 {
+			return uint64(n)
+		}
+	}
+	return 0
+}
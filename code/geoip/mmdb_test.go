@@ -0,0 +1,261 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// encode writes a value in the mmdb data format. Only the types the tests need are handled
+func encode(v interface{}) []byte {
+
+	ctrl := func(typ int, size int) []byte {
+		var b []byte
+		first := byte(0)
+		if typ < 8 {
+			first = byte(typ << 5)
+		}
+		if size < 29 {
+			b = append(b, first|byte(size))
+		} else {
+			b = append(b, first|29)
+		}
+		if typ >= 8 {
+			b = append(b, byte(typ-7))
+		}
+		if size >= 29 {
+			b = append(b, byte(size-29))
+		}
+		return b
+	}
+
+	switch v := v.(type) {
+	case string:
+		return append(ctrl(typeString, len(v)), v...)
+	case uint16:
+		return append(ctrl(typeUint16, 2), byte(v>>8), byte(v))
+	case uint32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return append(ctrl(typeUint32, 4), b...)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b := ctrl(typeMap, len(v))
+		for _, k := range keys {
+			b = append(b, encode(k)...)
+			b = append(b, encode(v[k])...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+// buildDB writes a database holding data for each prefix
+func buildDB(ipVersion, recordSize int, dbType string, prefixes map[string]map[string]interface{}) []byte {
+
+	type rec struct {
+		kind int // 0 empty, 1 node, 2 data
+		n    int
+	}
+	nodes := [][2]rec{{}}
+
+	var data []byte
+	var cidrs []string
+	for c := range prefixes {
+		cidrs = append(cidrs, c)
+	}
+	sort.Strings(cidrs)
+
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		ip := []byte(n.IP)
+		plen, _ := n.Mask.Size()
+		if ipVersion == 6 && len(ip) == 4 {
+			// ipv4 lives under ::/96
+			ip = append(make([]byte, 12), ip...)
+			plen += 96
+		}
+
+		off := len(data)
+		data = append(data, encode(prefixes[c])...)
+
+		node := 0
+		for i := 0; i < plen; i++ {
+			bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+			if i == plen-1 {
+				nodes[node][bit] = rec{2, off}
+				break
+			}
+			if nodes[node][bit].kind != 1 {
+				nodes = append(nodes, [2]rec{})
+				nodes[node][bit] = rec{1, len(nodes) - 1}
+			}
+			node = nodes[node][bit].n
+		}
+	}
+
+	count := len(nodes)
+	value := func(r rec) uint32 {
+		switch r.kind {
+		case 1:
+			return uint32(r.n)
+		case 2:
+			return uint32(count + 16 + r.n)
+		}
+		return uint32(count)
+	}
+
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		l, r := value(n[0]), value(n[1])
+		switch recordSize {
+		case 24:
+			buf.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(r >> 16), byte(r >> 8), byte(r)})
+		case 28:
+			buf.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(l>>20)&0xf0 | byte(r>>24)&0x0f, byte(r >> 16), byte(r >> 8), byte(r)})
+		case 32:
+			binary.Write(&buf, binary.BigEndian, []uint32{l, r})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data)
+	buf.Write(metadataMarker)
+	buf.Write(encode(map[string]interface{}{
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(recordSize),
+		"ip_version":                  uint16(ipVersion),
+		"database_type":               dbType,
+		"binary_format_major_version": uint16(2),
+	}))
+	return buf.Bytes()
+}
+
+var testCity = map[string]map[string]interface{}{
+	"1.2.3.0/24": {
+		"country": map[string]interface{}{"iso_code": "AU"},
+		"city":    map[string]interface{}{"names": map[string]interface{}{"en": "Sydney"}},
+	},
+	"198.51.100.0/24": {
+		"registered_country": map[string]interface{}{"iso_code": "US"},
+	},
+	"2001:db8::/32": {
+		"country": map[string]interface{}{"iso_code": "DE"},
+	},
+}
+
+var testASN = map[string]map[string]interface{}{
+	"1.2.0.0/16": {
+		"autonomous_system_number":       uint32(64500),
+		"autonomous_system_organization": "Example Hosting",
+	},
+}
+
+func TestReaderLookup(t *testing.T) {
+
+	for _, size := range []int{24, 28, 32} {
+		for _, version := range []int{4, 6} {
+
+			r, err := FromBytes(buildDB(version, size, "Test-City", testCity))
+			if err != nil {
+				t.Fatalf("%d/%d: %v", size, version, err)
+			}
+			if r.Type != "Test-City" {
+				t.Errorf("%d/%d: unexpected type %q", size, version, r.Type)
+			}
+
+			m, err := r.Lookup(net.ParseIP("1.2.3.4"))
+			if err != nil || field(m, "city", "names", "en") != "Sydney" {
+				t.Errorf("%d/%d: 1.2.3.4 got %v %v", size, version, m, err)
+			}
+			if m, err = r.Lookup(net.ParseIP("1.2.4.4")); err != nil || m != nil {
+				t.Errorf("%d/%d: 1.2.4.4 expected nothing, got %v %v", size, version, m, err)
+			}
+
+			m, err = r.Lookup(net.ParseIP("2001:db8::1"))
+			want := "DE"
+			if version == 4 {
+				want = ""
+			}
+			if err != nil || field(m, "country", "iso_code") != want {
+				t.Errorf("%d/%d: 2001:db8::1 got %v %v", size, version, m, err)
+			}
+		}
+	}
+}
+
+func TestDBLookup(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	city, asn := filepath.Join(dir, "city.mmdb"), filepath.Join(dir, "asn.mmdb")
+	ioutil.WriteFile(city, buildDB(6, 28, "Test-City", testCity), 0644)
+	ioutil.WriteFile(asn, buildDB(4, 24, "Test-ASN", testASN), 0644)
+
+	db, err := OpenDB([]string{city, asn})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want Location
+	}{
+		{"1.2.3.4", Location{Country: "AU", City: "Sydney", ASN: 64500, ASOrg: "Example Hosting"}},
+		{"1.2.200.1", Location{ASN: 64500, ASOrg: "Example Hosting"}},
+		{"198.51.100.7", Location{Country: "US"}},
+		{"2001:db8::1", Location{Country: "DE"}},
+		{"203.0.113.1", Location{}},
+		{"not an ip", Location{}},
+	}
+	for _, tt := range tests {
+		if got := db.Lookup(tt.addr); got != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.addr, tt.want, got)
+		}
+	}
+
+	if _, err := OpenDB([]string{filepath.Join(dir, "missing.mmdb")}); err == nil {
+		t.Error("expected an error for a missing database")
+	}
+}
+
+func TestDecodePointer(t *testing.T) {
+
+	// a string followed by a pointer back to it
+	d := decoder{buf: append(encode("abc"), 0x20, 0x00)}
+	v, next, err := d.decode(4, 0)
+	if err != nil || v != "abc" || next != 6 {
+		t.Errorf("expected abc at 6, got %v %d %v", v, next, err)
+	}
+
+	// a pointer to itself must not loop forever
+	d = decoder{buf: []byte{0x20, 0x00}}
+	if _, _, err := d.decode(0, 0); err == nil {
+		t.Error("expected an error for a pointer loop")
+	}
+}
+
+func TestFromBytesBad(t *testing.T) {
+
+	if _, err := FromBytes([]byte("not a database")); err == nil {
+		t.Error("expected an error for a file with no metadata")
+	}
+
+	db := buildDB(4, 24, "Test", testASN)
+	i := bytes.LastIndex(db, metadataMarker)
+	if _, err := FromBytes(db[i-10:]); err == nil {
+		t.Error("expected an error for a truncated tree")
+	}
+}
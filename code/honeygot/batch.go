@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	contentTypeNDJSON  = "application/x-ndjson"     // newline delimited json events
+	contentTypeBinary  = "application/octet-stream" // sealed or signed batch
+	sealMagic          = "HGBOX1"                   // starts every sealed batch
+	sealSuffix         = ".box"                     // added to the key of sealed batches
+	sealPublicKeyBytes = 32                         // size of a nacl box public key
+)
+
+// batch is a completed group of events ready to be stored by a sink
+type batch struct {
+	Key             string `json:"key"`             // name the batch is stored under
+	ContentType     string `json:"contentType"`     // type of the uncompressed events
+	ContentEncoding string `json:"contentEncoding"` // compression applied to Data. Empty for none
+
+	Sensor string    `json:"sensor"` // id of the sensor that captured the events
+	Events int       `json:"events"` // number of events in the batch. 0 if not known
+	First  time.Time `json:"first"`  // when the first event was added
+	Last   time.Time `json:"last"`   // when the last event was added
+
+	HostKeys []string `json:"hostKeys,omitempty"` // fingerprints of the ssh host keys offered by the sensor
+
+	Data []byte `json:"-"` // the batch body
+}
+
+// compressions maps the supported compression names to the key suffix they add
+var compressions = map[string]string{
+	"none": "",
+	"gzip": ".gz",
+}
+
+// ndjsonSuffix is the file type suffix of batch keys
+const ndjsonSuffix = ".ndjson"
+
+// batchTypeSuffix returns the file type suffix added to the keys of a sink. Sinks using
+// the legacy layout without compression get none so existing key names do not change
+func batchTypeSuffix(layout, compression string) string {
+	if layout == legacyKeyLayout && (compression == "" || compression == "none") {
+		return ""
+	}
+	return ndjsonSuffix
+}
+
+// newBatch creates a batch from newline delimited json events, compressing them as requested.
+// The key is given with its file type suffix and the compression suffix is added
+func newBatch(events []byte, key, compression string) (*batch, error) {
+
+	b := &batch{
+		ContentType: contentTypeNDJSON,
+		Data:        events,
+	}
+
+	switch compression {
+	case "", "none":
+	case "gzip":
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(events); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		b.Data = buf.Bytes()
+		b.ContentEncoding = "gzip"
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+
+	b.Key = key + compressions[compression]
+	return b, nil
+}
+
+// seal encrypts the batch so only the holder of the private key matching pub can read it.
+// A new key pair is made for every batch and the sealed batch is
+// sealMagic | ephemeral public key | nonce | nacl box of the data
+func (b *batch) seal(pub *[32]byte) error {
+
+	ephPub, ephPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err = io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return err
+	}
+
+	out := make([]byte, 0, len(sealMagic)+len(ephPub)+len(nonce)+len(b.Data)+box.Overhead)
+	out = append(out, sealMagic...)
+	out = append(out, ephPub[:]...)
+	out = append(out, nonce[:]...)
+	b.Data = box.Seal(out, b.Data, &nonce, pub, ephPriv)
+
+	// the content encoding would tell s3 clients to unzip the sealed data so it
+	// is left for the reader to find once the batch is opened
+	b.Key += sealSuffix
+	b.ContentType = contentTypeBinary
+	b.ContentEncoding = ""
+	return nil
+}
+
+// parseSealKey decodes a hex encoded nacl box public key
+func parseSealKey(s string) (*[32]byte, error) {
+	k, err := hex.DecodeString(s)
+	if err != nil || len(k) != sealPublicKeyBytes {
+		return nil, fmt.Errorf("seal key must be %d hex encoded bytes", sealPublicKeyBytes)
+	}
+	var pub [32]byte
+	copy(pub[:], k)
+	return &pub, nil
+}
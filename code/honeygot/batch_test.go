@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestNewBatch(t *testing.T) {
+
+	events := []byte("{\"User\":\"root\"}\n")
+
+	b, err := newBatch(events, "k.ndjson", "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Key != "k.ndjson.gz" || b.ContentEncoding != "gzip" || b.ContentType != contentTypeNDJSON {
+		t.Errorf("unexpected batch %+v", b)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(zr); !bytes.Equal(got, events) {
+		t.Errorf("expected %q, got %q", events, got)
+	}
+
+	if _, err := newBatch(events, "k", "lz4"); err == nil {
+		t.Error("expected an error for an unknown compression")
+	}
+}
+
+func TestBatchTypeSuffix(t *testing.T) {
+
+	tests := []struct {
+		layout, compression, want string
+	}{
+		{legacyKeyLayout, "none", ""},
+		{legacyKeyLayout, "", ""},
+		{legacyKeyLayout, "gzip", ".ndjson"},
+		{"{{.Sensor}}/{{.ID}}", "none", ".ndjson"},
+	}
+	for _, tt := range tests {
+		if got := batchTypeSuffix(tt.layout, tt.compression); got != tt.want {
+			t.Errorf("%s %s: expected %q, got %q", tt.layout, tt.compression, tt.want, got)
+		}
+	}
+}
+
+func TestBatchSeal(t *testing.T) {
+
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []byte("{\"Credentials\":\"secret\"}\n")
+	b, err := newBatch(events, "k.ndjson", "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.seal(pub); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Key != "k.ndjson.box" || b.ContentType != contentTypeBinary {
+		t.Errorf("unexpected sealed batch %+v", b)
+	}
+	if bytes.Contains(b.Data, []byte("secret")) {
+		t.Error("sealed batch holds the events in the clear")
+	}
+
+	// open it the way the report tool does
+	data := b.Data[len(sealMagic):]
+	var ephPub [32]byte
+	var nonce [24]byte
+	copy(ephPub[:], data)
+	copy(nonce[:], data[32:])
+	got, ok := box.Open(nil, data[32+24:], &nonce, &ephPub, priv)
+	if !ok || !bytes.Equal(got, events) {
+		t.Errorf("unable to open sealed batch: %v %q", ok, got)
+	}
+}
+
+func TestParseSealKey(t *testing.T) {
+	if _, err := parseSealKey(strings.Repeat("ab", 32)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, k := range []string{"", "abcd", strings.Repeat("zz", 32)} {
+		if _, err := parseSealKey(k); err == nil {
+			t.Errorf("%q: expected an error", k)
+		}
+	}
+}
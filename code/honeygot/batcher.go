@@ -1,205 +1,338 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
-	"encoding/json"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
-	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gombadi/honeygot/code/events"
+	"github.com/gombadi/honeygot/code/geoip"
 )
 
 type batcher struct {
-	batchChan chan *AuthEvent // channel to receive results on
-	wg        *sync.WaitGroup // wait group to signal when we exit
-	doneChan  chan struct{}   // chan to advise system is shutting down
-	extIP     string          // external ip of system to add to all events
-	s3Bucket  string          // s3 bucket to upload result batches to
-	lastPush  time.Time       // time of last remote push
-	max       int             // max number of items in a batch
+	queue        *eventQueue     // bounded queue to receive results on
+	wg           *sync.WaitGroup // wait group to signal when we exit
+	doneChan     chan struct{}   // chan to advise system is shutting down
+	extIP        string          // external ip of system to add to all events
+	outputs      []*sinkOutput   // sinks that every batch is sent to
+	flushChan    chan struct{}   // forces all batches to be sent
+	totalDropped uint64          // events dropped by the queue since start
+
+	schema string            // json schema events are written in
+	sensor string            // sensor id stamped on every event
+	tags   map[string]string // sensor tags stamped on every event
+	meta   *metadataProvider // instance metadata stamped on every event. nil if not configured
+	geo    *geoip.DB         // locates the source of every event. nil if not configured
+	rdns   *rdnsCache        // names the source of every event. nil if not configured
 }
 
-// bChan is a reference to the channel to send work on
-var bChan chan *AuthEvent
+// bQueue is a reference to the queue to send work on
+var bQueue *eventQueue
 var extIP string
 
-// newBatcher creates a new Batcher and configures
-func newBatcher(doneChan chan struct{}, flagURL string, wg *sync.WaitGroup) *batcher {
+// newBatcher creates a new Batcher and configures the sinks that batches are sent to
+func newBatcher(doneChan chan struct{}, bc BatcherConfig, sinks []SinkConfig, wg *sync.WaitGroup) (*batcher, error) {
 
 	b := &batcher{
-		doneChan: doneChan,
-		wg:       wg,
-		max:      62626, // max batch size to be less than 64k
-		lastPush: time.Now(),
+		doneChan:  doneChan,
+		wg:        wg,
+		queue:     newEventQueue(bc.QueueSize, bc.QueuePolicy),
+		flushChan: make(chan struct{}, 1),
+		schema:    bc.Schema,
+		sensor:    bc.Sensor,
+		tags:      bc.Tags,
+	}
+	if bc.Metadata.Provider == "ec2" {
+		b.meta = newMetadataProvider(bc.Metadata)
 	}
 
-	if b.s3Bucket = os.Getenv("BATCHER_S3_BUCKET"); b.s3Bucket == "" {
-		b.s3Bucket = flagURL
+	if len(bc.GeoIP) > 0 {
+		var err error
+		if b.geo, err = geoip.OpenDB(bc.GeoIP); err != nil {
+			return nil, fmt.Errorf("unable to open geoip database: %v", err)
+		}
+		log.Printf("locating sources with geoip databases %s\n", strings.Join(b.geo.Types(), ", "))
+	}
+
+	if bc.RDNS.Enabled {
+		b.rdns = newRDNSCache(bc.RDNS)
+	}
+
+	if bc.SpoolDir == "" {
+		log.Printf("warning - no spool dir configured. failed uploads will not be retried\n")
+	}
+
+	var signKey ed25519.PrivateKey
+	if bc.SignKey != "" {
+		var err error
+		if signKey, err = loadSignKey(bc.SignKey); err != nil {
+			return nil, fmt.Errorf("unable to load signing key: %v", err)
+		}
+		log.Printf("signing batches with key %x\n", []byte(signKey.Public().(ed25519.PublicKey)))
+	}
+
+	// batches spooled by older versions sit directly in the spool dir and belong
+	// to the s3 sink that was the only sink back then
+	legacy := -1
+	for i, sc := range sinks {
+		if sc.Type == "s3" {
+			legacy = i
+			break
+		}
+	}
+	if legacy < 0 {
+		legacy = 0
+	}
+
+	for i, sc := range sinks {
+		sink, err := newSink(sc)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %v", sc.Name, err)
+		}
+		o := &sinkOutput{
+			sink:      sink,
+			sensor:    bc.Sensor,
+			keyLayout: sc.keyLayout,
+			flushCfg:  sc.Flush,
+			compress:  sc.Compression,
+			keySuffix: batchTypeSuffix(sc.KeyLayout, sc.Compression),
+			sealKey:   sc.sealKey,
+		}
+
+		// every sink batches differently so each has its own chain
+		if signKey != nil {
+			chain := bc.Sensor + "/" + sink.Name()
+			if o.signer, err = newSigner(signKey, chain, bc.SignKey+"."+sink.Name()+".chain"); err != nil {
+				return nil, fmt.Errorf("sink %s: %v", sc.Name, err)
+			}
+		}
+
+		// each sink gets its own spool so they retry independently
+		if bc.SpoolDir != "" {
+			dir := filepath.Join(bc.SpoolDir, sink.Name())
+			if o.spool, err = newSpool(dir, sink.Write); err != nil {
+				return nil, fmt.Errorf("sink %s: unable to create spool dir: %v", sc.Name, err)
+			}
+			if i == legacy {
+				o.spool.adopt(bc.SpoolDir)
+			}
+		}
+		b.outputs = append(b.outputs, o)
 	}
 
 	// load external ip into global to be used if needed
-	extIP = b.getExtIP()
+	extIP = b.getExtIP(bc.ExtURL)
 
-	return b
+	return b, nil
 }
 
-// Start starts the Batcher running and listening on the bChan for items to post to remote url
-func (b *batcher) Start() (chan *AuthEvent, error) {
+// Start starts the Batcher running and listening on the bQueue for items to post to remote url
+func (b *batcher) Start() error {
 
-	if b.s3Bucket == "" {
-		return nil, errors.New("s3Bucket not set")
+	if len(b.outputs) == 0 {
+		return errors.New("no sinks configured")
 	}
 
-	b.batchChan = make(chan *AuthEvent)
-
-	// save a reference to the batch chan in global variable so it can be retrived
+	// save a reference to the queue in global variable so it can be retrived
 	// by AddToBatch
-	bChan = b.batchChan
+	bQueue = b.queue
 
 	if b.wg != nil {
 		b.wg.Add(1)
 	}
-	// create the results chan and start the goroutine to listen on it
+	if b.meta != nil {
+		b.meta.Start(b.doneChan)
+	}
+	if b.rdns != nil {
+		b.rdns.Start(b.doneChan)
+	}
+
+	// send any batches left over from the last run
+	for _, o := range b.outputs {
+		if o.spool != nil {
+			o.spool.Start()
+		}
+	}
+	// start the goroutine to listen on the queue
 	go b.run()
 
-	return b.batchChan, nil
+	return nil
 }
 
-// run runs in a goroutine and pulls results off the batchChan
-// gathers up into batches and then sends to remote microservice
+// run runs in a goroutine and pulls results off the queue
+// gathers up into a batch for each sink and sends them when the flush policy says so
 func (b *batcher) run() {
 
-	var bB bytes.Buffer
-	var res *AuthEvent
-
 	if b.wg != nil {
 		defer b.wg.Done()
 	}
 
-	ping := time.NewTicker(time.Minute * 1)
-
-	// loop
-	loopwhile := true
-	dowhile := true
-	for dowhile == true {
-
-		loopwhile = true
-		// remove all content from the buffer and start loading more
-		bB.Reset()
-
-		for loopwhile == true {
-			// wait for a result in the batchChan
-			select {
-			case <-ping.C:
-				// if last result was > 5 minutes ago then push now
-				if (time.Now().Unix() - b.lastPush.Unix()) > 1500 {
-					if x := bB.Len(); x > 0 {
-						b.pushToRemote(bB)
-						loopwhile = false
-					}
-				}
-			case <-b.doneChan:
-				dowhile = false
-				loopwhile = false
-			case res = <-b.batchChan:
-
-				// encode to json and write to byteBuffer
-				je, err := json.Marshal(res)
-				if err == nil {
-					bB.Write(je)
-					bB.Write([]byte("\n"))
-				}
-				if x := bB.Len(); x >= b.max {
-					b.pushToRemote(bB)
-					loopwhile = false
+	// check the batch ages every second so short max ages are honoured
+	ping := time.NewTicker(time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ping.C:
+			b.addDropReport()
+			for _, o := range b.outputs {
+				if o.tooOld() {
+					o.flush("max age")
 				}
 			}
+		case <-b.flushChan:
+			log.Printf("batcher forced flush\n")
+			b.addDropReport()
+			for _, o := range b.outputs {
+				o.flush("forced")
+			}
+		case <-b.queue.ready:
+			// take everything queued, pushing each time a batch is full
+			for res := b.queue.pop(); res != nil; res = b.queue.pop() {
+				b.addToBatches(res)
+			}
+		case <-b.doneChan:
+			b.shutdown()
+			return
 		}
 	}
-	// dropped out of loop so push the last items to remote service
-	if x := bB.Len(); x > 0 {
-		log.Printf("shutting down so pushing last results...\n")
-		b.pushToRemote(bB)
-	} else {
-		log.Printf("shutting down. No results to push\n")
+}
+
+// shutdown pushes everything left in the queue and the batches then stops the sinks
+func (b *batcher) shutdown() {
+
+	// the queue is closed so take whatever is left in it
+	for res := b.queue.pop(); res != nil; res = b.queue.pop() {
+		b.addToBatches(res)
+	}
+	b.addDropReport()
+	if b.totalDropped > 0 {
+		log.Printf("batcher dropped %d events in total as the queue was full\n", b.totalDropped)
+	}
+
+	log.Printf("shutting down so pushing last results...\n")
+	for _, o := range b.outputs {
+		o.flush("shutdown")
+		if o.spool != nil {
+			o.spool.Stop()
+		}
+		o.sink.Close()
 	}
-	// return and defer wg done
 }
 
-// pushToRemote will call the remote result microservice and post the result batch
-//func (b *batcher) pushToRemote(results []string) {
-func (b *batcher) pushToRemote(bB bytes.Buffer) {
+// Flush asks the batcher to send every batch now, whatever its size or age
+func (b *batcher) Flush() {
+	select {
+	case b.flushChan <- struct{}{}:
+	default:
+	}
+}
 
-	b.lastPush = time.Now()
+// addToBatches encodes an event to json once and adds it to the batch of every sink
+func (b *batcher) addToBatches(res *events.AuthEvent) {
+	b.enrich(res)
+	je, err := res.Encode(b.schema)
+	if err != nil {
+		log.Printf("batcher unable to encode event: %v\n", err)
+		return
+	}
+	je = append(je, '\n')
+	for _, o := range b.outputs {
+		o.add(je)
+	}
+}
 
-	yr, mth, day := time.Now().Date()
+// enrich stamps the sensor details onto an event. These are not part of the event hash
+// so the same event seen twice still matches
+func (b *batcher) enrich(res *events.AuthEvent) {
 
-	// generate the md5 checksum which is the s3 filename
-	h := md5.New()
-	io.WriteString(h, string(bB.Bytes()))
+	res.Sensor = b.sensor
+	res.Tags = b.tags
 
-	fileName := fmt.Sprintf("%v-%v/%v/honeygot-%x", yr, int(mth), day, h.Sum(nil))
+	if b.geo != nil && res.SrcIP != "" {
+		loc := b.geo.Lookup(res.SrcIP)
+		res.Country, res.City, res.ASN, res.ASOrg = loc.Country, loc.City, loc.ASN, loc.ASOrg
+	}
+	if b.rdns != nil && res.SrcIP != "" {
+		res.SrcHost = b.rdns.name(res.SrcIP)
+	}
 
-	if len(b.s3Bucket) > 1 {
-		// push to s3. Pull all session data from the environment or IAM role
-		sess := session.New()
-		svc := s3.New(sess)
+	if b.meta == nil {
+		return
+	}
+	m := b.meta.get()
+	res.InstanceID, res.Region, res.AZ, res.AMI = m.InstanceID, m.Region, m.AZ, m.AMI
 
-		params := &s3.PutObjectInput{
-			Bucket: aws.String(b.s3Bucket), // Required
-			Key:    aws.String(fileName),   // Required
-			Body:   bytes.NewReader([]byte(bB.Bytes())),
-		}
-		_, err := svc.PutObject(params)
-		if err != nil {
-			log.Printf("batcher postResult error: %v\n", err)
-		} else {
-			log.Printf("batcher pushed to s3: s3://%s/%s\n", b.s3Bucket, fileName)
-		}
-	} else {
-		log.Printf("warning - unable to push to s3 as no bucket name available. records lost\n")
+	// spot instances change address on every launch so the metadata is the better source
+	if m.PublicIP != "" {
+		res.DestIP = m.PublicIP
 	}
 }
 
-// addevent creates a goroutine and adds an item to the batcher chan
-func (b *batcher) addEvent(result *AuthEvent) {
-	if x := len(result.Hash); x < 3 {
-		result.updateHash()
+// addDropReport adds an event recording how many events the queue dropped since the last report
+func (b *batcher) addDropReport() {
+
+	d := b.queue.takeDropped()
+	if d == 0 {
+		return
 	}
+	b.totalDropped += d
+	log.Printf("batcher queue full - %d events dropped\n", d)
+
+	r := newAuthEvent("queueDrop", "", nil, nil)
+	r.TypeData = fmt.Sprintf("dropped: %d capacity: %d policy: %s", d, len(b.queue.items), b.queue.policy)
+	r.Details = &events.QueueDropDetails{Dropped: d, Capacity: len(b.queue.items), Policy: b.queue.policy}
+	r.UpdateHash()
+	b.addToBatches(r)
+}
 
-	go func(result *AuthEvent) {
-		bChan <- result
-	}(result)
+// newAuthEvent creates an event happening now on a connection from remote to local
+func newAuthEvent(authType, protocol string, remote, local net.Addr) *events.AuthEvent {
+	ae := events.New(authType, protocol, remote, local)
+	ae.DestIP = extIP
+	return ae
+}
 
+// addevent adds an item to the batcher queue
+func (b *batcher) addEvent(result *events.AuthEvent) {
+	addToBatch(result)
 }
 
-// AddToBatch creates a goroutine and adds an item to the batcher chan
-func addToBatch(result *AuthEvent) {
+// AddToBatch adds an item to the batcher queue. What happens when the queue is
+// full depends on the configured overflow policy and a closed queue counts the
+// event as dropped. Events sent before the batcher starts are thrown away
+func addToBatch(result *events.AuthEvent) {
+	q := bQueue
+	if q == nil {
+		return
+	}
+
 	if x := len(result.Hash); x < 3 {
-		result.updateHash()
+		result.UpdateHash()
 	}
 
-	go func(result *AuthEvent) {
-		bChan <- result
-	}(result)
+	q.push(result)
+}
 
+// Stop closes the queue so no more events are accepted and signals the batcher
+// to push everything already queued and exit
+func (b *batcher) Stop() {
+	b.queue.close()
+	close(b.doneChan)
 }
 
-func (b *batcher) getExtIP() string {
+func (b *batcher) getExtIP(extURL string) string {
 
-	var extURL, ip string
-	if extURL = os.Getenv("HONEYGOT_EXTURL"); extURL != "" {
+	var ip string
+	if extURL != "" {
 
 		// get our external ip address so we can add it to the results
 		resp, err := http.Get(extURL)
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gombadi/honeygot/code/events"
+)
+
+// Config describes everything a honeygot sensor runs. It is normally loaded
+// from the json file given with -config but can also be built from the
+// legacy command line flags and environment variables
+type Config struct {
+	Listeners []ListenerConfig `json:"listeners"` // protocol servers to start
+	Batcher   BatcherConfig    `json:"batcher"`   // how events are gathered up
+	Sinks     []SinkConfig     `json:"sinks"`     // every batch is sent to all of these
+	Sink      *SinkConfig      `json:"sink"`      // single sink from older config files. Added to Sinks
+
+	// ShutdownTimeout is how long open sessions are given to finish on shutdown - eg 30s
+	ShutdownTimeout string        `json:"shutdownTimeout"`
+	shutdownTimeout time.Duration // parsed value of ShutdownTimeout
+}
+
+// ListenerConfig describes a single emulated service
+type ListenerConfig struct {
+	Protocol string `json:"protocol"` // name of a registered protocol - eg ssh, mysql, http
+	Address  string `json:"address"`  // address to bind to. Empty means all addresses
+	Port     string `json:"port"`     // port to listen on
+	Network  string `json:"network"`  // tcp for dual stack, tcp4 or tcp6. Defaults to tcp
+	Banner   string `json:"banner"`   // version string or realm presented to clients
+	KeyDir   string `json:"keyDir"`   // ssh host keys are loaded from, or created once in, this directory
+
+	// Prompts are the keyboard-interactive prompts an ssh listener asks in turn, eg a
+	// password then a verification code. Defaults to Password:
+	Prompts []string `json:"prompts"`
+
+	// ProxyProtocol reads a PROXY protocol v1 or v2 header from every connection so the
+	// events show the real client behind a load balancer
+	ProxyProtocol  bool         `json:"proxyProtocol"`
+	TrustedProxies []string     `json:"trustedProxies"` // CIDRs that must send a header. Required with proxyProtocol
+	trustedProxies []*net.IPNet // parsed value of TrustedProxies
+}
+
+// BatcherConfig holds the settings for the event batcher
+type BatcherConfig struct {
+	ExtURL   string `json:"extURL"`   // url that returns our external ip address as plain text
+	SpoolDir string `json:"spoolDir"` // batches are written here until they are uploaded
+	Sensor   string `json:"sensor"`   // id of this sensor used in batch keys. Defaults to the host name
+	SignKey  string `json:"signKey"`  // ed25519 key file batches are signed with. Created if missing
+
+	Schema   string            `json:"schema"`   // event json schema - v1 or v2
+	Tags     map[string]string `json:"tags"`     // added to every event
+	Metadata MetadataConfig    `json:"metadata"` // instance details added to every event
+	GeoIP    []string          `json:"geoip"`    // .mmdb country, city or ASN databases used to locate the source address
+	RDNS     RDNSConfig        `json:"rdns"`     // reverse dns names of source addresses
+
+	QueueSize   int    `json:"queueSize"`   // max events waiting for the batcher
+	QueuePolicy string `json:"queuePolicy"` // drop-oldest, drop-newest or block when the queue is full
+}
+
+// MetadataConfig describes where the instance details added to events come from
+type MetadataConfig struct {
+	Provider string `json:"provider"` // ec2 or empty for none
+	Endpoint string `json:"endpoint"` // metadata service url. Defaults to the ec2 service
+	Refresh  string `json:"refresh"`  // how often the details are fetched again - eg 10m
+
+	refresh time.Duration // parsed value of Refresh
+}
+
+// RDNSConfig describes the reverse dns lookups of source addresses
+type RDNSConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Workers   int    `json:"workers"`   // lookups run at the same time. Defaults to 4
+	CacheTTL  string `json:"cacheTTL"`  // how long a name is kept - eg 1h
+	CacheSize int    `json:"cacheSize"` // most addresses kept. Defaults to 10000
+	Timeout   string `json:"timeout"`   // limit on each lookup - eg 2s
+	Resolver  string `json:"resolver"`  // dns server host:port to use instead of the system resolver
+
+	cacheTTL time.Duration // parsed value of CacheTTL
+	timeout  time.Duration // parsed value of Timeout
+}
+
+// SinkConfig describes where completed batches are sent
+type SinkConfig struct {
+	Name   string `json:"name"`   // unique name for log messages and the spool. Defaults to the type
+	Type   string `json:"type"`   // s3, file or stdout
+	Bucket string `json:"bucket"` // s3 bucket to upload result batches to
+	Dir    string `json:"dir"`    // directory the file sink writes batches to
+
+	// s3 upload options
+	Endpoint     string            `json:"endpoint"`     // url of an s3 compatible store. Empty for aws
+	Region       string            `json:"region"`       // region of the bucket. Defaults to the environment
+	SSE          string            `json:"sse"`          // server side encryption - AES256 or aws:kms
+	KMSKeyID     string            `json:"kmsKeyId"`     // kms key id or arn. Implies aws:kms
+	StorageClass string            `json:"storageClass"` // eg STANDARD_IA. Empty for the bucket default
+	Tags         map[string]string `json:"tags"`         // added to the sensor, events, first and last tags
+	Metadata     map[string]string `json:"metadata"`     // user metadata added to every object
+
+	Flush       FlushConfig `json:"flush"`       // when batches are sent to this sink
+	Compression string      `json:"compression"` // none or gzip
+
+	// SealKey is a hex encoded nacl box public key. When set every batch is encrypted to
+	// it so only the holder of the private key can read the events
+	SealKey string    `json:"sealKey"`
+	sealKey *[32]byte // parsed value of SealKey
+
+	// KeyLayout is a template for the name each batch is stored under - eg sensor={{.Sensor}}/dt={{.Date}}/{{.ID}}
+	KeyLayout string             `json:"keyLayout"`
+	keyLayout *template.Template // parsed value of KeyLayout
+}
+
+// FlushConfig decides when a batch is sent. The first limit reached triggers the send
+type FlushConfig struct {
+	MaxBytes  int    `json:"maxBytes"`  // send once the batch is this big. 0 means no limit
+	MaxEvents int    `json:"maxEvents"` // send once the batch holds this many events. 0 means no limit
+	MaxAge    string `json:"maxAge"`    // send once the oldest event has waited this long - eg 25m
+
+	maxAge time.Duration // parsed value of MaxAge
+}
+
+// loadConfig reads and validates the json config file at path
+func loadConfig(path string) (*Config, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+
+	// databases shipped next to the config file can be named without a directory
+	for i, p := range c.Batcher.GeoIP {
+		if !filepath.IsAbs(p) {
+			c.Batcher.GeoIP[i] = filepath.Join(filepath.Dir(path), p)
+		}
+	}
+
+	c.setDefaults()
+	if err = c.validate(); err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// flagConfig builds a config from the legacy command line flags and environment
+// variables. The environment overrides the flags as it always has
+func flagConfig(sshPort, httpPort, mysqlPort, bucket string) (*Config, error) {
+
+	c := &Config{}
+
+	// the env only moves the mysql server, it never enables it
+	if port := os.Getenv("HONEYGOT_MYSQLPORT"); port != "" && mysqlPort != "" {
+		mysqlPort = port
+	}
+	if b := os.Getenv("BATCHER_S3_BUCKET"); b != "" {
+		bucket = b
+	}
+
+	for _, l := range []ListenerConfig{
+		{Protocol: "ssh", Port: sshPort},
+		{Protocol: "mysql", Port: mysqlPort},
+		{Protocol: "http", Port: httpPort},
+	} {
+		if l.Port != "" {
+			c.Listeners = append(c.Listeners, l)
+		}
+	}
+
+	c.Batcher.ExtURL = os.Getenv("HONEYGOT_EXTURL")
+	c.Batcher.Metadata.Provider = os.Getenv("HONEYGOT_METADATA")
+	c.Batcher.SpoolDir = os.Getenv("HONEYGOT_SPOOLDIR")
+	c.Sinks = []SinkConfig{{Type: "s3", Bucket: bucket}}
+
+	c.setDefaults()
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// setDefaults fills in any optional values that were not supplied
+func (c *Config) setDefaults() {
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		l.Protocol = strings.ToLower(l.Protocol)
+		if lt, ok := listenerTypes[l.Protocol]; ok && l.Banner == "" {
+			l.Banner = lt.banner
+		}
+		if l.Network == "" {
+			l.Network = "tcp"
+		}
+		if l.Protocol == "ssh" && len(l.Prompts) == 0 {
+			l.Prompts = []string{"Password: "}
+		}
+	}
+	if c.Sink != nil {
+		c.Sinks = append(c.Sinks, *c.Sink)
+		c.Sink = nil
+	}
+	for i := range c.Sinks {
+		sc := &c.Sinks[i]
+		if sc.Type == "" {
+			sc.Type = "s3"
+		}
+		if sc.Name == "" {
+			sc.Name = sc.Type
+		}
+		if sc.Flush.MaxBytes == 0 && sc.Flush.MaxEvents == 0 {
+			sc.Flush.MaxBytes = 62626 // max batch size to be less than 64k
+		}
+		if sc.Flush.MaxAge == "" {
+			sc.Flush.MaxAge = "25m"
+		}
+		if sc.Compression == "" {
+			sc.Compression = "none"
+		}
+		if sc.KeyLayout == "" {
+			sc.KeyLayout = legacyKeyLayout
+		}
+		if sc.KMSKeyID != "" && sc.SSE == "" {
+			sc.SSE = s3.ServerSideEncryptionAwsKms
+		}
+	}
+	if c.Batcher.Sensor == "" {
+		c.Batcher.Sensor, _ = os.Hostname()
+		if c.Batcher.Sensor == "" {
+			c.Batcher.Sensor = "honeygot"
+		}
+	}
+	if c.Batcher.QueueSize == 0 {
+		c.Batcher.QueueSize = 10000
+	}
+	if c.Batcher.QueuePolicy == "" {
+		c.Batcher.QueuePolicy = dropOldest
+	}
+	if c.Batcher.Schema == "" {
+		c.Batcher.Schema = events.SchemaV1
+	}
+	if c.Batcher.Metadata.Endpoint == "" {
+		c.Batcher.Metadata.Endpoint = ec2MetadataEndpoint
+	}
+	if c.Batcher.Metadata.Refresh == "" {
+		c.Batcher.Metadata.Refresh = "10m"
+	}
+	if rc := &c.Batcher.RDNS; rc.Enabled {
+		if rc.Workers == 0 {
+			rc.Workers = 4
+		}
+		if rc.CacheTTL == "" {
+			rc.CacheTTL = "1h"
+		}
+		if rc.CacheSize == 0 {
+			rc.CacheSize = 10000
+		}
+		if rc.Timeout == "" {
+			rc.Timeout = "2s"
+		}
+	}
+	if c.ShutdownTimeout == "" {
+		c.ShutdownTimeout = "30s"
+	}
+}
+
+// validate checks the config and returns an error describing every problem found
+func (c *Config) validate() error {
+
+	var errs []string
+
+	if len(c.Listeners) == 0 {
+		errs = append(errs, "no listeners configured")
+	}
+
+	seen := make(map[string]int)
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		name := fmt.Sprintf("listeners[%d]", i)
+
+		if _, ok := listenerTypes[l.Protocol]; !ok {
+			errs = append(errs, fmt.Sprintf("%s: unknown protocol %q. Available: %s", name, l.Protocol, strings.Join(listenerProtocols(), ", ")))
+		}
+
+		port, err := strconv.Atoi(l.Port)
+		if err != nil || port < 1 || port > 65535 {
+			errs = append(errs, fmt.Sprintf("%s: invalid port %q", name, l.Port))
+		}
+
+		ip := net.ParseIP(l.Address)
+		if l.Address != "" && ip == nil {
+			errs = append(errs, fmt.Sprintf("%s: invalid address %q", name, l.Address))
+		}
+
+		switch l.Network {
+		case "tcp":
+		case "tcp4":
+			if ip != nil && ip.To4() == nil {
+				errs = append(errs, fmt.Sprintf("%s: address %s is not ipv4", name, l.Address))
+			}
+		case "tcp6":
+			if ip != nil && ip.To4() != nil {
+				errs = append(errs, fmt.Sprintf("%s: address %s is not ipv6", name, l.Address))
+			}
+		default:
+			errs = append(errs, fmt.Sprintf("%s: unknown network %q. Available: tcp, tcp4, tcp6", name, l.Network))
+		}
+
+		// tcp4 and tcp6 can share a port but a dual stack tcp listener can not
+		addr := net.JoinHostPort(l.Address, l.Port)
+		for _, n := range []string{"tcp", "tcp4", "tcp6"} {
+			if l.Network != "tcp" && n != "tcp" && n != l.Network {
+				continue
+			}
+			if j, ok := seen[n+" "+addr]; ok {
+				errs = append(errs, fmt.Sprintf("%s: address %s already used by listeners[%d]", name, addr, j))
+				break
+			}
+		}
+		seen[l.Network+" "+addr] = i
+
+		if l.Protocol != "ssh" && (l.KeyDir != "" || len(l.Prompts) > 0) {
+			errs = append(errs, fmt.Sprintf("%s: keyDir and prompts are only used by ssh", name))
+		}
+		for _, p := range l.Prompts {
+			if strings.TrimSpace(p) == "" {
+				errs = append(errs, fmt.Sprintf("%s: empty prompt", name))
+			}
+		}
+
+		if len(l.TrustedProxies) > 0 && !l.ProxyProtocol {
+			errs = append(errs, fmt.Sprintf("%s: trustedProxies needs proxyProtocol", name))
+		}
+		if l.ProxyProtocol && len(l.TrustedProxies) == 0 {
+			// trusting every source would let any client choose the address in its events
+			errs = append(errs, fmt.Sprintf("%s: proxyProtocol needs trustedProxies", name))
+		}
+		l.trustedProxies = nil
+		for _, cidr := range l.TrustedProxies {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: invalid trusted proxy %q", name, cidr))
+				continue
+			}
+			l.trustedProxies = append(l.trustedProxies, n)
+		}
+	}
+
+	var err error
+	if c.shutdownTimeout, err = time.ParseDuration(c.ShutdownTimeout); err != nil || c.shutdownTimeout < 0 {
+		errs = append(errs, fmt.Sprintf("invalid shutdownTimeout %q", c.ShutdownTimeout))
+	}
+
+	if c.Batcher.QueueSize < 1 {
+		errs = append(errs, fmt.Sprintf("batcher: invalid queueSize %d", c.Batcher.QueueSize))
+	}
+	switch c.Batcher.QueuePolicy {
+	case dropOldest, dropNewest, blockFull:
+	default:
+		errs = append(errs, fmt.Sprintf("batcher: unknown queuePolicy %q. Available: %s, %s, %s", c.Batcher.QueuePolicy, dropOldest, dropNewest, blockFull))
+	}
+
+	switch c.Batcher.Schema {
+	case events.SchemaV1, events.SchemaV2:
+	default:
+		errs = append(errs, fmt.Sprintf("batcher: unknown schema %q. Available: %s, %s", c.Batcher.Schema, events.SchemaV1, events.SchemaV2))
+	}
+	switch c.Batcher.Metadata.Provider {
+	case "", "ec2":
+	default:
+		errs = append(errs, fmt.Sprintf("batcher: unknown metadata provider %q. Available: ec2", c.Batcher.Metadata.Provider))
+	}
+	if c.Batcher.Metadata.refresh, err = time.ParseDuration(c.Batcher.Metadata.Refresh); err != nil || c.Batcher.Metadata.refresh <= 0 {
+		errs = append(errs, fmt.Sprintf("batcher: invalid metadata refresh %q", c.Batcher.Metadata.Refresh))
+	}
+	if rc := &c.Batcher.RDNS; rc.Enabled {
+		if rc.Workers < 1 {
+			errs = append(errs, fmt.Sprintf("batcher: invalid rdns workers %d", rc.Workers))
+		}
+		if rc.CacheSize < 1 {
+			errs = append(errs, fmt.Sprintf("batcher: invalid rdns cacheSize %d", rc.CacheSize))
+		}
+		if rc.cacheTTL, err = time.ParseDuration(rc.CacheTTL); err != nil || rc.cacheTTL <= 0 {
+			errs = append(errs, fmt.Sprintf("batcher: invalid rdns cacheTTL %q", rc.CacheTTL))
+		}
+		if rc.timeout, err = time.ParseDuration(rc.Timeout); err != nil || rc.timeout <= 0 {
+			errs = append(errs, fmt.Sprintf("batcher: invalid rdns timeout %q", rc.Timeout))
+		}
+		if _, _, err = net.SplitHostPort(rc.Resolver); rc.Resolver != "" && err != nil {
+			errs = append(errs, fmt.Sprintf("batcher: invalid rdns resolver %q. Expected host:port", rc.Resolver))
+		}
+	}
+
+	// the sensor id ends up in keys and paths so must be a plain name
+	if c.Batcher.Sensor != filepath.Base(c.Batcher.Sensor) || strings.HasPrefix(c.Batcher.Sensor, ".") {
+		errs = append(errs, fmt.Sprintf("batcher: invalid sensor %q", c.Batcher.Sensor))
+	}
+
+	if len(c.Sinks) == 0 {
+		errs = append(errs, "no sinks configured")
+	}
+
+	sinkNames := make(map[string]bool)
+	for i := range c.Sinks {
+		sc := &c.Sinks[i]
+		name := fmt.Sprintf("sinks[%d]", i)
+
+		if _, ok := compressions[sc.Compression]; !ok {
+			errs = append(errs, fmt.Sprintf("%s: unsupported compression %q. Available: none, gzip", name, sc.Compression))
+		}
+		if sc.Flush.MaxBytes < 0 || sc.Flush.MaxEvents < 0 {
+			errs = append(errs, fmt.Sprintf("%s: flush limits can not be negative", name))
+		}
+		if sc.Flush.maxAge, err = time.ParseDuration(sc.Flush.MaxAge); err != nil || sc.Flush.maxAge <= 0 {
+			errs = append(errs, fmt.Sprintf("%s: invalid flush maxAge %q", name, sc.Flush.MaxAge))
+		}
+
+		if sc.SealKey != "" {
+			if sc.sealKey, err = parseSealKey(sc.SealKey); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+		if sc.keyLayout, err = parseKeyLayout(sc.KeyLayout); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: invalid keyLayout %q: %v", name, sc.KeyLayout, err))
+		}
+
+		switch sc.Type {
+		case "s3":
+			if sc.Bucket == "" {
+				errs = append(errs, fmt.Sprintf("%s: s3 bucket not set", name))
+			}
+			errs = append(errs, sc.validateS3(name)...)
+		case "file":
+			if sc.Dir == "" {
+				errs = append(errs, fmt.Sprintf("%s: file sink dir not set", name))
+			}
+		case "stdout":
+		default:
+			errs = append(errs, fmt.Sprintf("%s: unknown type %q", name, sc.Type))
+		}
+
+		// the name is used as the spool directory so must be unique and a plain file name
+		if sc.Name != filepath.Base(sc.Name) || sc.Name == "." || sc.Name == ".." || sc.Name == spoolFailedDir {
+			errs = append(errs, fmt.Sprintf("%s: invalid name %q", name, sc.Name))
+		}
+		if sinkNames[sc.Name] {
+			errs = append(errs, fmt.Sprintf("%s: name %q already used. Set a unique name", name, sc.Name))
+		}
+		sinkNames[sc.Name] = true
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// s3StorageClasses are the storage classes an s3 sink can upload to
+var s3StorageClasses = []string{"STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA",
+	"INTELLIGENT_TIERING", "GLACIER", "GLACIER_IR", "DEEP_ARCHIVE"}
+
+// validateS3 checks the s3 upload options
+func (sc *SinkConfig) validateS3(name string) []string {
+
+	var errs []string
+
+	switch sc.SSE {
+	case "", s3.ServerSideEncryptionAes256:
+		if sc.KMSKeyID != "" {
+			errs = append(errs, fmt.Sprintf("%s: kmsKeyId needs sse %s", name, s3.ServerSideEncryptionAwsKms))
+		}
+	case s3.ServerSideEncryptionAwsKms:
+	default:
+		errs = append(errs, fmt.Sprintf("%s: unknown sse %q. Available: %s, %s", name, sc.SSE, s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms))
+	}
+
+	if sc.StorageClass != "" {
+		found := false
+		for _, c := range s3StorageClasses {
+			found = found || c == sc.StorageClass
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: unknown storageClass %q. Available: %s", name, sc.StorageClass, strings.Join(s3StorageClasses, ", ")))
+		}
+	}
+
+	// s3 allows 10 tags and 4 are always added
+	if len(sc.Tags) > 6 {
+		errs = append(errs, fmt.Sprintf("%s: too many tags. At most 6 can be set", name))
+	}
+	for k := range sc.Tags {
+		switch k {
+		case "sensor", "events", "first", "last":
+			errs = append(errs, fmt.Sprintf("%s: tag %q is set by honeygot", name, k))
+		}
+	}
+
+	if sc.Endpoint != "" {
+		if u, err := url.Parse(sc.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("%s: invalid endpoint %q", name, sc.Endpoint))
+		}
+	}
+	return errs
+}
+
+// addr returns the address the listener should bind to
+func (l ListenerConfig) addr() string {
+	return net.JoinHostPort(l.Address, l.Port)
+}
+
+// listen opens the listening socket, reading PROXY protocol headers if configured
+func (l ListenerConfig) listen() (net.Listener, error) {
+	ln, err := net.Listen(l.Network, l.addr())
+	if err != nil || !l.ProxyProtocol {
+		return ln, err
+	}
+	return newProxyListener(ln, l.trustedProxies), nil
+}
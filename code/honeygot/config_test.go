@@ -0,0 +1,324 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+
+	tests := []struct {
+		name string
+		cfg  Config
+		errs []string // substrings expected in the error. none means valid
+	}{
+		{
+			name: "valid",
+			cfg: Config{
+				Listeners: []ListenerConfig{
+					{Protocol: "ssh", Port: "22"},
+					{Protocol: "HTTP", Address: "127.0.0.1", Port: "80"},
+					{Protocol: "mysql", Port: "3306", Network: "tcp4"},
+					{Protocol: "mysql", Address: "::", Port: "3306", Network: "tcp6"},
+				},
+				Sinks: []SinkConfig{{Bucket: "bucket"}, {Type: "file", Dir: "/tmp"}, {Type: "stdout"}},
+			},
+		},
+		{
+			name: "legacy sink",
+			cfg: Config{
+				Listeners: []ListenerConfig{{Protocol: "ssh", Port: "22"}},
+				Sink:      &SinkConfig{Type: "s3", Bucket: "bucket"},
+			},
+		},
+		{
+			name: "empty",
+			cfg:  Config{},
+			errs: []string{"no listeners configured", "no sinks configured"},
+		},
+		{
+			name: "bad listeners",
+			cfg: Config{
+				Listeners: []ListenerConfig{
+					{Protocol: "ftp", Port: "21"},
+					{Protocol: "ssh", Port: "x"},
+					{Protocol: "ssh", Port: "70000"},
+					{Protocol: "mysql", Address: "nowhere", Port: "3306"},
+					{Protocol: "http", Port: "80"},
+					{Protocol: "ssh", Port: "80"},
+				},
+				Sinks: []SinkConfig{{Bucket: "bucket"}},
+			},
+			errs: []string{
+				`listeners[0]: unknown protocol "ftp"`,
+				`listeners[1]: invalid port "x"`,
+				`listeners[2]: invalid port "70000"`,
+				`listeners[3]: invalid address "nowhere"`,
+				`listeners[5]: address :80 already used by listeners[4]`,
+			},
+		},
+		{
+			name: "networks",
+			cfg: Config{
+				Listeners: []ListenerConfig{
+					{Protocol: "ssh", Port: "22", Network: "tcp4"},
+					{Protocol: "ssh", Port: "22", Network: "tcp6"},
+					{Protocol: "http", Port: "22"},
+					{Protocol: "http", Address: "::1", Port: "80", Network: "tcp4"},
+					{Protocol: "http", Address: "127.0.0.1", Port: "81", Network: "tcp6"},
+					{Protocol: "mysql", Port: "3306", Network: "udp"},
+					{Protocol: "mysql", Address: "2001:db8::1", Port: "3307"},
+				},
+				Sinks: []SinkConfig{{Bucket: "bucket"}},
+			},
+			errs: []string{
+				`listeners[2]: address :22 already used by listeners[0]`,
+				`listeners[3]: address ::1 is not ipv4`,
+				`listeners[4]: address 127.0.0.1 is not ipv6`,
+				`listeners[5]: unknown network "udp"`,
+			},
+		},
+		{
+			name: "proxy protocol",
+			cfg: Config{
+				Listeners: []ListenerConfig{
+					{Protocol: "ssh", Port: "22", ProxyProtocol: true, TrustedProxies: []string{"10.0.0.0/8", "fd00::/8"}},
+					{Protocol: "http", Port: "80", ProxyProtocol: true, TrustedProxies: []string{"10.0.0.1"}},
+					{Protocol: "mysql", Port: "3306", TrustedProxies: []string{"10.0.0.0/8"}},
+					{Protocol: "ssh", Port: "2222", ProxyProtocol: true},
+				},
+				Sinks: []SinkConfig{{Bucket: "bucket"}},
+			},
+			errs: []string{
+				`listeners[1]: invalid trusted proxy "10.0.0.1"`,
+				`listeners[2]: trustedProxies needs proxyProtocol`,
+				`listeners[3]: proxyProtocol needs trustedProxies`,
+			},
+		},
+		{
+			name: "ssh options",
+			cfg: Config{
+				Listeners: []ListenerConfig{
+					{Protocol: "ssh", Port: "22", KeyDir: "/var/lib/honeygot/ssh", Prompts: []string{"Password: ", "Verification code: "}},
+					{Protocol: "mysql", Port: "3306", KeyDir: "/var/lib/honeygot/ssh"},
+					{Protocol: "http", Port: "80", Prompts: []string{"Password: "}},
+					{Protocol: "ssh", Port: "2222", Prompts: []string{" "}},
+				},
+				Sinks: []SinkConfig{{Bucket: "bucket"}},
+			},
+			errs: []string{
+				"listeners[1]: keyDir and prompts are only used by ssh",
+				"listeners[2]: keyDir and prompts are only used by ssh",
+				"listeners[3]: empty prompt",
+			},
+		},
+		{
+			name: "bad sinks",
+			cfg: Config{
+				Listeners: []ListenerConfig{{Protocol: "ssh", Port: "22"}},
+				Sinks: []SinkConfig{
+					{Type: "s3"},
+					{Type: "file"},
+					{Type: "kafka"},
+					{Type: "stdout"},
+					{Type: "stdout"},
+					{Type: "stdout", Name: "a/b"},
+				},
+			},
+			errs: []string{
+				"sinks[0]: s3 bucket not set",
+				"sinks[1]: file sink dir not set",
+				`sinks[2]: unknown type "kafka"`,
+				`sinks[4]: name "stdout" already used`,
+				`sinks[5]: invalid name "a/b"`,
+			},
+		},
+		{
+			name: "bad flush policy",
+			cfg: Config{
+				Listeners: []ListenerConfig{{Protocol: "ssh", Port: "22"}},
+				Sinks: []SinkConfig{
+					{Bucket: "bucket", Flush: FlushConfig{MaxAge: "often"}},
+					{Type: "stdout", Flush: FlushConfig{MaxEvents: -1}},
+				},
+			},
+			errs: []string{
+				`sinks[0]: invalid flush maxAge "often"`,
+				"sinks[1]: flush limits can not be negative",
+			},
+		},
+		{
+			name: "compression and sealing",
+			cfg: Config{
+				Listeners: []ListenerConfig{{Protocol: "ssh", Port: "22"}},
+				Sinks: []SinkConfig{
+					{Bucket: "bucket", Compression: "gzip"},
+					{Type: "stdout", Compression: "zstd"},
+					{Type: "file", Name: "f", Dir: "/tmp", Compression: "lz4"},
+					{Type: "stdout", Name: "sealed", SealKey: "1234"},
+				},
+			},
+			errs: []string{
+				`sinks[1]: unsupported compression "zstd"`,
+				`sinks[2]: unsupported compression "lz4"`,
+				"sinks[3]: seal key must be 32 hex encoded bytes",
+			},
+		},
+		{
+			name: "key layout and sensor",
+			cfg: Config{
+				Listeners: []ListenerConfig{{Protocol: "ssh", Port: "22"}},
+				Batcher:   BatcherConfig{Sensor: "a/b"},
+				Sinks: []SinkConfig{
+					{Bucket: "bucket", KeyLayout: "sensor={{.Sensor}}/dt={{.Date}}/{{.ID}}"},
+					{Type: "stdout", KeyLayout: "{{.Date}}"},
+				},
+			},
+			errs: []string{
+				`batcher: invalid sensor "a/b"`,
+				`sinks[1]: invalid keyLayout "{{.Date}}"`,
+			},
+		},
+		{
+			name: "s3 options",
+			cfg: Config{
+				Listeners: []ListenerConfig{{Protocol: "ssh", Port: "22"}},
+				Sinks: []SinkConfig{
+					{Name: "kms", Bucket: "bucket", KMSKeyID: "alias/honeygot", StorageClass: "STANDARD_IA", Endpoint: "http://127.0.0.1:9000"},
+					{Name: "a", Bucket: "bucket", SSE: "AES256", KMSKeyID: "key"},
+					{Name: "b", Bucket: "bucket", SSE: "rot13", StorageClass: "COLD"},
+					{Name: "c", Bucket: "bucket", Tags: map[string]string{"sensor": "x"}, Endpoint: "localhost"},
+				},
+			},
+			errs: []string{
+				"sinks[1]: kmsKeyId needs sse aws:kms",
+				`sinks[2]: unknown sse "rot13"`,
+				`sinks[2]: unknown storageClass "COLD"`,
+				`sinks[3]: tag "sensor" is set by honeygot`,
+				`sinks[3]: invalid endpoint "localhost"`,
+			},
+		},
+		{
+			name: "rdns",
+			cfg: Config{
+				Listeners: []ListenerConfig{{Protocol: "ssh", Port: "22"}},
+				Batcher:   BatcherConfig{RDNS: RDNSConfig{Enabled: true, Workers: -1, CacheTTL: "forever", Timeout: "0s", Resolver: "127.0.0.1"}},
+				Sinks:     []SinkConfig{{Bucket: "bucket"}},
+			},
+			errs: []string{
+				`batcher: invalid rdns workers -1`,
+				`batcher: invalid rdns cacheTTL "forever"`,
+				`batcher: invalid rdns timeout "0s"`,
+				`batcher: invalid rdns resolver "127.0.0.1"`,
+			},
+		},
+		{
+			name: "schema and metadata",
+			cfg: Config{
+				Listeners: []ListenerConfig{{Protocol: "ssh", Port: "22"}},
+				Batcher:   BatcherConfig{Schema: "v3", Metadata: MetadataConfig{Provider: "gce", Refresh: "never"}},
+				Sinks:     []SinkConfig{{Bucket: "bucket"}},
+			},
+			errs: []string{
+				`batcher: unknown schema "v3"`,
+				`batcher: unknown metadata provider "gce"`,
+				`batcher: invalid metadata refresh "never"`,
+			},
+		},
+		{
+			name: "bad shutdown timeout",
+			cfg: Config{
+				Listeners:       []ListenerConfig{{Protocol: "ssh", Port: "22"}},
+				Sinks:           []SinkConfig{{Bucket: "bucket"}},
+				ShutdownTimeout: "soon",
+			},
+			errs: []string{`invalid shutdownTimeout "soon"`},
+		},
+	}
+
+	for _, tt := range tests {
+		c := tt.cfg
+		c.setDefaults()
+		err := c.validate()
+
+		if len(tt.errs) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+			continue
+		}
+		for _, e := range tt.errs {
+			if !strings.Contains(err.Error(), e) {
+				t.Errorf("%s: error %q does not contain %q", tt.name, err, e)
+			}
+		}
+	}
+}
+
+func TestFlagConfigMySQLPort(t *testing.T) {
+
+	os.Setenv("HONEYGOT_MYSQLPORT", "3307")
+	defer os.Unsetenv("HONEYGOT_MYSQLPORT")
+
+	// the env alone must not start a mysql server
+	c, err := flagConfig("22", "", "", "bucket")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(c.Listeners) != 1 || c.Listeners[0].Protocol != "ssh" {
+		t.Errorf("expected only the ssh listener, got %+v", c.Listeners)
+	}
+
+	// but it does move one that was asked for
+	c, err = flagConfig("", "", "3306", "bucket")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(c.Listeners) != 1 || c.Listeners[0].Port != "3307" {
+		t.Errorf("expected mysql on 3307, got %+v", c.Listeners)
+	}
+}
+
+func TestLoadConfigGeoIPPaths(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "honeygot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "honeygot.json")
+	cfg := `{"listeners": [{"protocol": "ssh", "port": "22"}], "sink": {"type": "stdout"},
+		"batcher": {"geoip": ["GeoLite2-Country.mmdb", "/opt/geoip/GeoLite2-ASN.mmdb"]}}`
+	if err = ioutil.WriteFile(path, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "GeoLite2-Country.mmdb"), "/opt/geoip/GeoLite2-ASN.mmdb"}
+	if len(c.Batcher.GeoIP) != 2 || c.Batcher.GeoIP[0] != want[0] || c.Batcher.GeoIP[1] != want[1] {
+		t.Errorf("expected %v, got %v", want, c.Batcher.GeoIP)
+	}
+}
+
+func TestLoadExampleConfig(t *testing.T) {
+
+	// the README shows this file as the example config
+	c, err := loadConfig("../../aws/autobuild/honeygot/honeygot.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Listeners) != 1 || len(c.Sinks) != 1 || c.Batcher.Schema != "v2" {
+		t.Errorf("unexpected example config %+v", c)
+	}
+}
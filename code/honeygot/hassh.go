@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/gombadi/honeygot/code/events"
+)
+
+const (
+	msgKexInit     = 20    // SSH_MSG_KEXINIT
+	maxKexInitRead = 35000 // most a client can send before its KEXINIT - version line and one packet
+)
+
+var errShortKexInit = errors.New("kexinit incomplete")
+
+// kexSniffer keeps a copy of what a client sends until its KEXINIT has been read, so the
+// algorithms it offers can be recorded without changing the ssh package
+type kexSniffer struct {
+	net.Conn
+
+	mu   sync.Mutex
+	buf  []byte
+	done bool
+	kex  *events.KexInit
+}
+
+// Read passes data through to the ssh handshake and parses the client KEXINIT
+func (k *kexSniffer) Read(p []byte) (int, error) {
+
+	n, err := k.Conn.Read(p)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.done && n > 0 {
+		k.buf = append(k.buf, p[:n]...)
+		kex, perr := parseKexInit(k.buf)
+		if perr != errShortKexInit || len(k.buf) > maxKexInitRead {
+			k.kex, k.done, k.buf = kex, true, nil
+		}
+	}
+	return n, err
+}
+
+// kexInit returns the algorithms the client offered or nil if its KEXINIT was not read
+func (k *kexSniffer) kexInit() *events.KexInit {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.kex
+}
+
+// hassh returns the HASSH fingerprint of the client or "" if its KEXINIT was not read
+func (k *kexSniffer) hassh() string {
+	kex := k.kexInit()
+	if kex == nil {
+		return ""
+	}
+	return hassh(kex)
+}
+
+// hassh is the md5 of the client kex, cipher, mac and compression lists as described at
+// https://github.com/salesforce/hassh
+func hassh(kex *events.KexInit) string {
+	s := strings.Join([]string{
+		strings.Join(kex.Kex, ","),
+		strings.Join(kex.Ciphers, ","),
+		strings.Join(kex.MACs, ","),
+		strings.Join(kex.Compression, ","),
+	}, ";")
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseKexInit reads the version line and first binary packet a client sends and
+// returns the algorithms in its KEXINIT. errShortKexInit means more data is needed
+func parseKexInit(buf []byte) (*events.KexInit, error) {
+
+	// the version line ends the identification
+	i := bytes.Index(buf, []byte("\n"))
+	if i < 0 {
+		return nil, errShortKexInit
+	}
+	if !bytes.HasPrefix(buf, []byte("SSH-")) {
+		return nil, errors.New("no ssh version line")
+	}
+	pkt := buf[i+1:]
+
+	if len(pkt) < 5 {
+		return nil, errShortKexInit
+	}
+	length := binary.BigEndian.Uint32(pkt)
+	padding := uint32(pkt[4])
+	if length > maxKexInitRead || padding+1 > length {
+		return nil, errors.New("invalid packet length")
+	}
+	if uint32(len(pkt)-4) < length {
+		return nil, errShortKexInit
+	}
+	payload := pkt[5 : 4+length-padding]
+
+	// message type and 16 byte cookie
+	if len(payload) < 17 || payload[0] != msgKexInit {
+		return nil, errors.New("first packet is not a kexinit")
+	}
+	payload = payload[17:]
+
+	var lists [10][]string
+	for n := range lists {
+		if len(payload) < 4 {
+			return nil, errors.New("short kexinit")
+		}
+		l := binary.BigEndian.Uint32(payload)
+		if uint32(len(payload)-4) < l {
+			return nil, errors.New("short kexinit")
+		}
+		if l > 0 {
+			lists[n] = strings.Split(string(payload[4:4+l]), ",")
+		}
+		payload = payload[4+l:]
+	}
+
+	// kex, host key, then the client to server and server to client pairs
+	return &events.KexInit{
+		Kex:         lists[0],
+		HostKey:     lists[1],
+		Ciphers:     lists[2],
+		MACs:        lists[4],
+		Compression: lists[6],
+	}, nil
+}
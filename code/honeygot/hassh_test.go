@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testKexInit builds the version line and KEXINIT packet a client sends
+func testKexInit(lists ...string) []byte {
+
+	payload := append([]byte{msgKexInit}, make([]byte, 16)...)
+	for _, l := range lists {
+		payload = append(payload, u32(len(l))...)
+		payload = append(payload, l...)
+	}
+	payload = append(payload, 0, 0, 0, 0, 0)
+
+	padding := 8 - (len(payload)+5)%8 + 4
+	pkt := u32(len(payload) + padding + 1)
+	pkt = append(pkt, byte(padding))
+	pkt = append(pkt, payload...)
+	pkt = append(pkt, make([]byte, padding)...)
+
+	return append([]byte("SSH-2.0-Test\r\n"), pkt...)
+}
+
+// u32 encodes n as an ssh uint32
+func u32(n int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b
+}
+
+var testKexLists = []string{
+	"curve25519-sha256,diffie-hellman-group14-sha1", "ssh-ed25519",
+	"aes128-ctr", "aes256-ctr", "hmac-sha2-256", "hmac-sha1", "none", "none", "", "",
+}
+
+func TestParseKexInit(t *testing.T) {
+
+	buf := testKexInit(testKexLists...)
+
+	kex, err := parseKexInit(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(kex.Kex, " ") != "curve25519-sha256 diffie-hellman-group14-sha1" || kex.HostKey[0] != "ssh-ed25519" ||
+		kex.Ciphers[0] != "aes128-ctr" || kex.MACs[0] != "hmac-sha2-256" || kex.Compression[0] != "none" {
+		t.Errorf("unexpected algorithms %+v", kex)
+	}
+	if h := hassh(kex); h != "c10186e7085a862e2fddf54d4e7d61fa" {
+		t.Errorf("unexpected hassh %s", h)
+	}
+
+	for _, n := range []int{5, 20, len(buf) - 1} {
+		if _, err := parseKexInit(buf[:n]); err != errShortKexInit {
+			t.Errorf("%d bytes: expected more to be needed, got %v", n, err)
+		}
+	}
+	if _, err := parseKexInit([]byte("GET / HTTP/1.1\r\n\r\n")); err == nil || err == errShortKexInit {
+		t.Errorf("expected an error for a non ssh client, got %v", err)
+	}
+}
+
+func TestKexSniffer(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+	k := &kexSniffer{Conn: server}
+
+	// the client sends in small pieces
+	buf := testKexInit(testKexLists...)
+	go func() {
+		for len(buf) > 0 {
+			n := 7
+			if n > len(buf) {
+				n = len(buf)
+			}
+			client.Write(buf[:n])
+			buf = buf[n:]
+		}
+	}()
+
+	p := make([]byte, 4)
+	for k.kexInit() == nil {
+		if _, err := k.Read(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h := k.hassh(); h != "c10186e7085a862e2fddf54d4e7d61fa" {
+		t.Errorf("unexpected hassh %s", h)
+	}
+	if k.buf != nil {
+		t.Error("expected the copy to be dropped once parsed")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeyFiles are the host keys every ssh listener offers, named like the openssh
+// key files so keys from a real server can be dropped in
+var hostKeyFiles = []struct {
+	file     string
+	generate func() (interface{}, error)
+}{
+	{"ssh_host_rsa_key", func() (interface{}, error) { return rsa.GenerateKey(rand.Reader, 2048) }},
+	{"ssh_host_ecdsa_key", func() (interface{}, error) { return ecdsa.GenerateKey(elliptic.P256(), rand.Reader) }},
+	{"ssh_host_ed25519_key", func() (interface{}, error) {
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		return k, err
+	}},
+}
+
+// loadHostKeys returns the rsa, ecdsa and ed25519 host keys in dir, creating any that are
+// missing so clients see the same keys after a restart. An empty dir creates keys that
+// only last until the sensor stops
+func loadHostKeys(dir string) ([]ssh.Signer, error) {
+
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, hk := range hostKeyFiles {
+
+		path := filepath.Join(dir, hk.file)
+
+		var key interface{}
+		var data []byte
+		err := os.ErrNotExist
+		if dir != "" {
+			data, err = ioutil.ReadFile(path)
+		}
+		switch {
+		case err == nil:
+			if key, err = ssh.ParseRawPrivateKey(data); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+		case os.IsNotExist(err):
+			if key, err = hk.generate(); err != nil {
+				return nil, err
+			}
+			if dir != "" {
+				if err = writeHostKey(path, key); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, err
+		}
+
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// writeHostKey saves a new private key in pkcs8 form along with its public key
+func writeHostKey(path string, key interface{}) error {
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return err
+	}
+	log.Printf("created ssh host key %s\n", path)
+	return ioutil.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644)
+}
+
+// hostKeyFingerprint describes a host key the way ssh-keygen -l does - eg ssh-ed25519 SHA256:...
+func hostKeyFingerprint(pub ssh.PublicKey) string {
+	return pub.Type() + " " + ssh.FingerprintSHA256(pub)
+}
+
+// sensorHostKeys holds the fingerprints of the host keys offered by every ssh listener.
+// They are added to the metadata of each batch
+var sensorHostKeys = struct {
+	sync.Mutex
+	fps map[string]bool
+}{fps: make(map[string]bool)}
+
+// addSensorHostKey records the fingerprint of a host key in use
+func addSensorHostKey(fp string) {
+	sensorHostKeys.Lock()
+	defer sensorHostKeys.Unlock()
+	sensorHostKeys.fps[fp] = true
+}
+
+// hostKeyFingerprints returns the sorted fingerprints of every host key in use
+func hostKeyFingerprints() []string {
+	sensorHostKeys.Lock()
+	defer sensorHostKeys.Unlock()
+	var fps []string
+	for fp := range sensorHostKeys.fps {
+		fps = append(fps, fp)
+	}
+	sort.Strings(fps)
+	return fps
+}
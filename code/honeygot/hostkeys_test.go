@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoadHostKeys(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "honeygot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyDir := filepath.Join(dir, "ssh")
+
+	first, err := loadHostKeys(keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{ssh.KeyAlgoRSA, ssh.KeyAlgoECDSA256, ssh.KeyAlgoED25519}
+	if len(first) != len(want) {
+		t.Fatalf("expected %d keys, got %d", len(want), len(first))
+	}
+	for i, s := range first {
+		if s.PublicKey().Type() != want[i] {
+			t.Errorf("key %d: expected %s, got %s", i, want[i], s.PublicKey().Type())
+		}
+	}
+
+	for _, hk := range hostKeyFiles {
+		fi, err := os.Stat(filepath.Join(keyDir, hk.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("%s: expected mode 0600, got %v", hk.file, fi.Mode().Perm())
+		}
+		if _, err = os.Stat(filepath.Join(keyDir, hk.file+".pub")); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// a restart offers the same keys
+	second, err := loadHostKeys(keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range first {
+		if a, b := hostKeyFingerprint(first[i].PublicKey()), hostKeyFingerprint(second[i].PublicKey()); a != b {
+			t.Errorf("key %d changed from %s to %s", i, a, b)
+		}
+	}
+
+	// without a key dir every start has new keys
+	ephemeral, err := loadHostKeys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostKeyFingerprint(ephemeral[0].PublicKey()) == hostKeyFingerprint(first[0].PublicKey()) {
+		t.Error("expected new keys without a key dir")
+	}
+
+	ioutil.WriteFile(filepath.Join(keyDir, "ssh_host_ecdsa_key"), []byte("not a key"), 0600)
+	if _, err = loadHostKeys(keyDir); err == nil {
+		t.Error("expected an error for a bad key file")
+	}
+}
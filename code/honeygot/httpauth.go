@@ -1,75 +1,156 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/gombadi/honeygot/code/events"
 )
 
 type HttpAuth struct {
+	listenerCounters
+	connTracker
 	b      *batcher
-	port   string // port to listen on
+	lc     ListenerConfig // address, port and realm to use
 	socket net.Listener
+	srv    *http.Server
+}
+
+func init() {
+	registerListener("http", "Restricted", newHttpAuth)
+}
+
+// newHttpAuth creates a new http server that is started by calling Start
+func newHttpAuth(lc ListenerConfig, b *batcher) Listener {
+	return &HttpAuth{
+		lc: lc,
+		b:  b,
+	}
 }
 
 // Start starts the httpAuth servers listening on the requested port
 // and sends connection details to the batcher
-func startHttp(port string, b *batcher) (*HttpAuth, error) {
+func (h *HttpAuth) Start() error {
+
+	var err error
+
+	h.socket, err = h.lc.listen()
+	if err != nil {
+		return err
+	}
+	h.socket = &sessionListener{Listener: h.socket, protocol: "http"}
 
-	h := &HttpAuth{
-		port: port,
-		b:    b,
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", h.authHandler)
+
+	h.srv = &http.Server{
+		Handler:     mux,
+		ConnState:   h.connState,
+		ConnContext: sessionContext,
 	}
 
 	// start listening on a background goroutine
 	go h.listenForConn()
 
-	return h, nil
+	return nil
+}
+
+// Name returns the protocol and address of the server
+func (h *HttpAuth) Name() string {
+	return "http " + h.lc.addr()
 }
 
 // Close will close the listening server and shutdown the system
-func (h *HttpAuth) Close() {
-	h.socket.Close()
+func (h *HttpAuth) Close() error {
+	if h.socket == nil {
+		return nil
+	}
+	return h.socket.Close()
+}
+
+// Drain waits for in progress requests to finish. Any connections still
+// open at the deadline are closed and the number closed is returned
+func (h *HttpAuth) Drain(deadline time.Time) int {
+	if h.srv == nil {
+		return 0
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	err := h.srv.Shutdown(ctx)
+
+	// connections are untracked once their handler has returned, so waiting
+	// for them also waits for any events the handlers are still producing
+	closed := h.connTracker.Drain(deadline)
+	if err != nil {
+		h.srv.Close()
+	}
+	return closed
 }
 
 // listenForConn runs in a goroutine to listen for incoming connections
 func (h *HttpAuth) listenForConn() {
 
-	http.HandleFunc("/", authHandler)
-	//
-	err := http.ListenAndServe(":"+h.port, nil)
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	// Close shuts the socket underneath Serve so that is a normal exit
+	err := h.srv.Serve(h.socket)
+	if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+		log.Printf("http server Serve failed: %v - http server exiting\n", err)
 	}
 }
 
+// connState is called by the http server as client connections change state
+func (h *HttpAuth) connState(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		// called from Serve before the connection is handled and Shutdown waits
+		// for Serve to return, so a connection is always tracked before Drain
+		h.addConnection()
+		h.trackConn(c)
+	case http.StateClosed, http.StateHijacked:
+		if sess, ok := c.(*clientSession); ok {
+			sess.end(strings.ToLower(state.String()))
+		}
+		h.untrackConn(c)
+	}
+}
+
+type sessionKey struct{}
+
+// sessionContext makes the session of a connection available to its requests
+func sessionContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, sessionKey{}, c)
+}
+
 // authHandler is called in a goroutine to handle each incoming request
-func authHandler(w http.ResponseWriter, r *http.Request) {
+func (h *HttpAuth) authHandler(w http.ResponseWriter, r *http.Request) {
 
 	// pull the auth details from the request
 	user, pass, ok := r.BasicAuth()
 	if ok == true {
 
-		host, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			host = ""
-		}
-		r := &AuthEvent{
-			Time:        fmt.Sprintf("%d", time.Now().Unix()),
-			AuthType:    "httpAuth",
-			SrcIP:       host,
-			DestIP:      extIP,
-			User:        user,
-			Credentials: strconv.QuoteToASCII(pass),
+		remote, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+		ae := newAuthEvent("httpAuth", "http", remote, local)
+		if sess, ok := r.Context().Value(sessionKey{}).(*clientSession); ok {
+			ae.SessionID = sess.id
 		}
-		addToBatch(r)
+		ae.User = user
+		ae.Credentials = strconv.QuoteToASCII(pass)
+		ae.Details = &events.HTTPDetails{Method: r.Method, Host: r.Host, Path: r.URL.Path, UserAgent: r.UserAgent()}
+		addToBatch(ae)
+		h.addAuthEvent()
 
 	}
 	// always return auth fail
-	w.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", h.lc.Banner))
 	http.Error(w, "authorization failed", http.StatusUnauthorized)
 }
 
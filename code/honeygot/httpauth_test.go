@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gombadi/honeygot/code/events"
+)
+
+func TestHttpAuthDrain(t *testing.T) {
+
+	old := bQueue
+	defer func() { bQueue = old }()
+	bQueue = newEventQueue(20, dropNewest)
+
+	h := newHttpAuth(ListenerConfig{Protocol: "http", Address: "127.0.0.1", Port: "0", Network: "tcp", Banner: "Restricted"}, nil).(*HttpAuth)
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the keep-alive connection is left idle
+	req, _ := http.NewRequest("GET", "http://"+h.socket.Addr().String()+"/", nil)
+	req.SetBasicAuth("admin", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	h.Close()
+	if n := h.Drain(time.Now().Add(2 * time.Second)); n != 0 {
+		t.Errorf("expected the idle connection to close cleanly, %d were forced", n)
+	}
+
+	var got []*events.AuthEvent
+	for ev := bQueue.pop(); ev != nil; ev = bQueue.pop() {
+		got = append(got, ev)
+	}
+	if len(got) != 3 || got[0].AuthType != "connect" || got[1].AuthType != "httpAuth" || got[2].AuthType != "disconnect" {
+		t.Fatalf("expected connect, httpAuth and disconnect events, got %+v", got)
+	}
+	if got[1].User != "admin" || got[1].SessionID != got[0].SessionID {
+		t.Errorf("unexpected auth event %+v", got[1])
+	}
+}
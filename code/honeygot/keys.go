@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// legacyKeyLayout is the key layout used before layouts could be configured - eg 2016-1/2/honeygot-<md5>
+const legacyKeyLayout = `{{.Time.Year}}-{{printf "%d" .Time.Month}}/{{.Time.Day}}/honeygot-{{.Hash}}`
+
+// keyFields are the values available to a key layout template
+type keyFields struct {
+	Sensor string    // id of the sensor that captured the events
+	Time   time.Time // time of the first event in the batch, in UTC
+	Date   string    // Time as 2006-01-02
+	Hour   string    // Time hour as 00-23
+	Hash   string    // md5 of the uncompressed batch
+	ID     string    // random uuid
+}
+
+// newKeyFields returns the key values for a batch of events started at t
+func newKeyFields(sensor string, t time.Time, events []byte) keyFields {
+	t = t.UTC()
+	return keyFields{
+		Sensor: sensor,
+		Time:   t,
+		Date:   t.Format("2006-01-02"),
+		Hour:   t.Format("15"),
+		Hash:   fmt.Sprintf("%x", md5.Sum(events)),
+		ID:     newUUID(),
+	}
+}
+
+// parseKeyLayout parses a key layout template and checks it produces usable keys
+func parseKeyLayout(layout string) (*template.Template, error) {
+
+	t, err := template.New("key").Parse(layout)
+	if err != nil {
+		return nil, err
+	}
+
+	// two batches with different content must never share a key
+	now := time.Now()
+	k1, err := batchKey(t, newKeyFields("sensor", now, []byte("a")))
+	if err != nil {
+		return nil, err
+	}
+	k2, err := batchKey(t, newKeyFields("sensor", now, []byte("b")))
+	if err != nil {
+		return nil, err
+	}
+	if k1 == k2 {
+		return nil, errors.New("layout must include {{.Hash}} or {{.ID}}")
+	}
+	return t, nil
+}
+
+// batchKey returns the name a batch is stored under
+func batchKey(layout *template.Template, f keyFields) (string, error) {
+
+	var b bytes.Buffer
+	if err := layout.Execute(&b, f); err != nil {
+		return "", err
+	}
+
+	// the key is also used as a path by the file sink so keep it inside the sink dir
+	key := b.String()
+	if key == "" || key == ".." || strings.HasPrefix(key, "/") || strings.HasPrefix(key, "../") || path.Clean(key) != key {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return key, nil
+}
+
+// newUUID returns a random version 4 uuid
+func newUUID() string {
+	u := make([]byte, 16)
+	rand.Read(u)
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
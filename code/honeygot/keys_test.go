@@ -0,0 +1,61 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchKey(t *testing.T) {
+
+	ts := time.Date(2016, 1, 2, 13, 4, 5, 0, time.UTC)
+	f := newKeyFields("sensor-a", ts, []byte("events"))
+
+	tests := []struct {
+		layout string
+		want   string // regexp the key must match
+	}{
+		{legacyKeyLayout, `^2016-1/2/honeygot-[0-9a-f]{32}$`},
+		{"sensor={{.Sensor}}/dt={{.Date}}/hour={{.Hour}}/{{.ID}}", `^sensor=sensor-a/dt=2016-01-02/hour=13/[0-9a-f-]{36}$`},
+		{`{{.Time.Format "2006/01/02"}}/{{.Hash}}`, `^2016/01/02/[0-9a-f]{32}$`},
+	}
+
+	for _, tt := range tests {
+		l, err := parseKeyLayout(tt.layout)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.layout, err)
+			continue
+		}
+		key, err := batchKey(l, f)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.layout, err)
+			continue
+		}
+		if !regexp.MustCompile(tt.want).MatchString(key) {
+			t.Errorf("%s: key %q does not match %s", tt.layout, key, tt.want)
+		}
+	}
+}
+
+func TestParseKeyLayoutErrors(t *testing.T) {
+
+	tests := []struct {
+		layout string
+		err    string
+	}{
+		{"{{.Date}}/honeygot", "must include"},
+		{"{{.Nope}}/{{.ID}}", "Nope"},
+		{"/{{.Date}}/{{.ID}}", "invalid key"},
+		{"../{{.ID}}", "invalid key"},
+		{"{{.Date}}//{{.ID}}", "invalid key"},
+		{"{{.Date", "unclosed action"},
+	}
+
+	for _, tt := range tests {
+		_, err := parseKeyLayout(tt.layout)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.layout, tt.err, err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Listener is implemented by every emulated protocol server
+type Listener interface {
+	Start() error         // start listening and handling connections in the background
+	Close() error         // stop accepting new connections
+	Drain(time.Time) int  // wait for open sessions until the deadline then close them
+	Name() string         // protocol and address used in log messages
+	Stats() ListenerStats // counters since the listener was created
+}
+
+// ListenerStats holds the counters reported by a Listener
+type ListenerStats struct {
+	Connections uint64 // connections accepted
+	AuthEvents  uint64 // auth events sent to the batcher
+}
+
+// listenerCounters can be embedded in a protocol server to provide the Stats method
+type listenerCounters struct {
+	connections uint64
+	authEvents  uint64
+}
+
+func (lc *listenerCounters) addConnection() { atomic.AddUint64(&lc.connections, 1) }
+func (lc *listenerCounters) addAuthEvent()  { atomic.AddUint64(&lc.authEvents, 1) }
+
+// Stats returns the current counter values
+func (lc *listenerCounters) Stats() ListenerStats {
+	return ListenerStats{
+		Connections: atomic.LoadUint64(&lc.connections),
+		AuthEvents:  atomic.LoadUint64(&lc.authEvents),
+	}
+}
+
+// connTracker can be embedded in a protocol server to keep track of the open
+// client connections so they can be drained on shutdown
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// trackConn records a new client connection
+func (ct *connTracker) trackConn(c net.Conn) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.conns == nil {
+		ct.conns = make(map[net.Conn]struct{})
+	}
+	ct.conns[c] = struct{}{}
+	ct.wg.Add(1)
+}
+
+// untrackConn removes a client connection once its handler has finished
+func (ct *connTracker) untrackConn(c net.Conn) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if _, ok := ct.conns[c]; ok {
+		delete(ct.conns, c)
+		ct.wg.Done()
+	}
+}
+
+// Drain waits for all open connections to finish. Any still open at the
+// deadline are closed and the number closed is returned
+func (ct *connTracker) Drain(deadline time.Time) int {
+
+	done := make(chan struct{})
+	go func() {
+		ct.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-time.After(time.Until(deadline)):
+	}
+
+	ct.mu.Lock()
+	closed := len(ct.conns)
+	for c := range ct.conns {
+		if s, ok := c.(*clientSession); ok {
+			s.shutdown()
+		} else {
+			c.Close()
+		}
+	}
+	ct.mu.Unlock()
+
+	// the handlers untrack their conns once they see the close
+	<-done
+	return closed
+}
+
+// listenerFactory creates a new, not yet started, listener for a protocol
+type listenerFactory func(lc ListenerConfig, b *batcher) Listener
+
+type listenerType struct {
+	banner  string          // banner used when the config does not supply one
+	factory listenerFactory // creates the listener
+}
+
+// listenerTypes holds all protocols that can be used in the config file
+var listenerTypes = make(map[string]listenerType)
+
+// registerListener makes a protocol available to the config file. It is called
+// from the init function of each protocol
+func registerListener(protocol, banner string, f listenerFactory) {
+	if _, ok := listenerTypes[protocol]; ok {
+		panic("registerListener: protocol registered twice: " + protocol)
+	}
+	listenerTypes[protocol] = listenerType{banner: banner, factory: f}
+}
+
+// newListener creates the listener described by lc
+func newListener(lc ListenerConfig, b *batcher) (Listener, error) {
+	lt, ok := listenerTypes[lc.Protocol]
+	if !ok {
+		return nil, fmt.Errorf("unknown protocol %q", lc.Protocol)
+	}
+	return lt.factory(lc, b), nil
+}
+
+// listenerProtocols returns the sorted names of all registered protocols
+func listenerProtocols() []string {
+	var p []string
+	for k := range listenerTypes {
+		p = append(p, k)
+	}
+	sort.Strings(p)
+	return p
+}
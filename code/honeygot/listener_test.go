@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewListenerUnknown(t *testing.T) {
+	if _, err := newListener(ListenerConfig{Protocol: "telnet", Port: "23"}, nil); err == nil || !strings.Contains(err.Error(), "telnet") {
+		t.Errorf("expected an unknown protocol error, got %v", err)
+	}
+}
+
+func TestRegisterListenerTwice(t *testing.T) {
+
+	before := listenerTypes["ssh"]
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic registering ssh twice")
+		}
+		if listenerTypes["ssh"].banner != before.banner {
+			t.Error("the first registration was replaced")
+		}
+	}()
+	registerListener("ssh", "SSH-2.0-other", newSSHServer)
+}
+
+func TestNewListenerRegistered(t *testing.T) {
+
+	protocols := listenerProtocols()
+	if strings.Join(protocols, ",") != "http,mysql,ssh" {
+		t.Fatalf("unexpected protocols %v", protocols)
+	}
+
+	for _, p := range protocols {
+		lc := ListenerConfig{Protocol: p, Address: "127.0.0.1", Port: "0", Network: "tcp", Banner: listenerTypes[p].banner}
+		l, err := newListener(lc, nil)
+		if err != nil {
+			t.Errorf("%s: %v", p, err)
+			continue
+		}
+		if want := p + " 127.0.0.1:0"; l.Name() != want {
+			t.Errorf("%s: expected name %q, got %q", p, want, l.Name())
+		}
+		if s := l.Stats(); s.Connections != 0 || s.AuthEvents != 0 {
+			t.Errorf("%s: expected new counters, got %+v", p, s)
+		}
+		if err = l.Close(); err != nil {
+			t.Errorf("%s: close before start: %v", p, err)
+		}
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 )
 
+var configFile string
 var sshPort string
 var mysqlPort string
 var httpPort string
@@ -18,64 +20,89 @@ var batcherBucket string
 // main is the application start point
 func main() {
 
-	// Flags are set during testing but env used during lambda runs
+	// Flags are set during testing but a config file is used on the sensors
+	flag.StringVar(&configFile, "config", "", "Load all settings from this json config file")
 	flag.StringVar(&sshPort, "sshport", "", "Enable SSH Server on this port")
 	flag.StringVar(&httpPort, "httpport", "", "Enable http Server on this port")
 	flag.StringVar(&mysqlPort, "mysqlport", "", "Enable MySQL Server on this port")
 	flag.StringVar(&batcherBucket, "batcher-bucket", "", "S3 bucket to sent events to")
 	flag.Parse()
 
+	var cfg *Config
+	var err error
+	if configFile != "" {
+		cfg, err = loadConfig(configFile)
+	} else {
+		cfg, err = flagConfig(sshPort, httpPort, mysqlPort, batcherBucket)
+	}
+	if err != nil {
+		log.Fatalf("invalid configuration - err: %v\n", err)
+	}
+
 	doneChan := make(chan struct{})
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	var wg sync.WaitGroup
-	var err error
-	var atleastonestarted bool
 
 	// setup the batcher to process results
-	b := newBatcher(doneChan, batcherBucket, &wg)
-	_, err = b.Start()
+	b, err := newBatcher(doneChan, cfg.Batcher, cfg.Sinks, &wg)
+	if err == nil {
+		err = b.Start()
+	}
 	if err != nil {
 		log.Fatalf("failed to start batcher - err: %v\n", err)
 	}
 
-	if sshPort != "" {
-		// start the ssh server
-		_, err := startSSH(sshPort, b)
-		if err != nil {
-			log.Fatalf("start ssh failed. err: %v\n", err)
+	var listeners []Listener
+	for _, lc := range cfg.Listeners {
+		l, err := newListener(lc, b)
+		if err == nil {
+			err = l.Start()
 		}
-		log.Printf("ssh server started on port %s\n", sshPort)
-		atleastonestarted = true
-	}
-
-	if mysqlPort != "" {
-		// start the mysql server
-		_, err := startMySQL(mysqlPort, b)
 		if err != nil {
-			log.Fatalf("start mysql failed. err: %v\n", err)
+			log.Fatalf("start %s failed. err: %v\n", lc.Protocol, err)
 		}
-		log.Printf("mysql server started on port %s\n", mysqlPort)
-		atleastonestarted = true
+		log.Printf("%s server started\n", l.Name())
+		listeners = append(listeners, l)
 	}
 
-	if httpPort != "" {
-		// start the http server
-		_, err := startHttp(httpPort, b)
-		if err != nil {
-			log.Fatalf("start http failed. err: %v\n", err)
+	// SIGUSR1 sends all batches now without waiting for them to fill
+	flushChan := make(chan os.Signal, 1)
+	signal.Notify(flushChan, syscall.SIGUSR1)
+	go func() {
+		for range flushChan {
+			b.Flush()
 		}
-		log.Printf("http server started on port %s\n", httpPort)
-		atleastonestarted = true
-	}
+	}()
 
 	// shutting down
-	if atleastonestarted == true {
+	if len(listeners) > 0 {
 		fmt.Printf("\nShutting down system on signal: %v\n", <-sigChan)
 	}
-	close(doneChan)
-	//sref.Close()
+	signal.Stop(flushChan)
+
+	// stop accepting new connections then give open sessions until the deadline to finish
+	for _, l := range listeners {
+		l.Close()
+	}
+	deadline := time.Now().Add(cfg.shutdownTimeout)
+	var lwg sync.WaitGroup
+	for _, l := range listeners {
+		lwg.Add(1)
+		go func(l Listener) {
+			defer lwg.Done()
+			if n := l.Drain(deadline); n > 0 {
+				log.Printf("%s server closed %d sessions at shutdown deadline\n", l.Name(), n)
+			}
+			st := l.Stats()
+			log.Printf("%s server closed. connections: %d auth events: %d\n", l.Name(), st.Connections, st.AuthEvents)
+		}(l)
+	}
+	lwg.Wait()
+
+	// all sessions are finished so no more events can be produced
+	b.Stop()
 
 	wg.Wait()
 	fmt.Printf("Shutdown complete\n")
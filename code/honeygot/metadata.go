@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ec2MetadataEndpoint = "http://169.254.169.254" // default instance metadata service
+	ec2TokenTTL         = "21600"                  // seconds an IMDSv2 token is valid for
+)
+
+// instanceMeta describes the host the sensor runs on
+type instanceMeta struct {
+	PublicIP   string
+	InstanceID string
+	Region     string
+	AZ         string
+	AMI        string
+}
+
+// metadataProvider keeps the instance metadata stamped onto every event up to date
+type metadataProvider struct {
+	endpoint string        // base url of the metadata service
+	refresh  time.Duration // how often the metadata is fetched again
+	client   *http.Client
+
+	mu   sync.RWMutex
+	meta instanceMeta
+}
+
+// newMetadataProvider creates a provider for the ec2 instance metadata service
+func newMetadataProvider(mc MetadataConfig) *metadataProvider {
+	return &metadataProvider{
+		endpoint: strings.TrimRight(mc.Endpoint, "/"),
+		refresh:  mc.refresh,
+		client:   &http.Client{Timeout: 2 * time.Second},
+	}
+}
+
+// Start fetches the metadata and keeps refreshing it until done is closed
+func (m *metadataProvider) Start(done chan struct{}) {
+
+	m.update()
+
+	go func() {
+		t := time.NewTicker(m.refresh)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				m.update()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// get returns the latest metadata
+func (m *metadataProvider) get() instanceMeta {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.meta
+}
+
+// update fetches the metadata, keeping the old values if the service can not be reached
+func (m *metadataProvider) update() {
+
+	meta, err := m.fetch()
+	if err != nil {
+		log.Printf("unable to fetch instance metadata: %v\n", err)
+		return
+	}
+
+	m.mu.Lock()
+	old := m.meta
+	m.meta = meta
+	m.mu.Unlock()
+
+	if meta != old {
+		log.Printf("instance metadata: id %s ip %s region %s az %s ami %s\n", meta.InstanceID, meta.PublicIP, meta.Region, meta.AZ, meta.AMI)
+	}
+}
+
+// fetch reads the metadata using the IMDSv2 session token flow
+func (m *metadataProvider) fetch() (instanceMeta, error) {
+
+	var meta instanceMeta
+
+	req, err := http.NewRequest("PUT", m.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return meta, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", ec2TokenTTL)
+	token, err := m.do(req)
+	if err != nil {
+		return meta, fmt.Errorf("token: %v", err)
+	}
+
+	for path, dst := range map[string]*string{
+		"instance-id":                 &meta.InstanceID,
+		"placement/region":            &meta.Region,
+		"placement/availability-zone": &meta.AZ,
+		"ami-id":                      &meta.AMI,
+		"public-ipv4":                 &meta.PublicIP,
+	} {
+		req, err := http.NewRequest("GET", m.endpoint+"/latest/meta-data/"+path, nil)
+		if err != nil {
+			return meta, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		v, err := m.do(req)
+		if err != nil && path != "public-ipv4" {
+			// instances without a public address have no public-ipv4
+			return meta, fmt.Errorf("%s: %v", path, err)
+		}
+		*dst = v
+	}
+	return meta, nil
+}
+
+// do sends a metadata request and returns the body
+func (m *metadataProvider) do(req *http.Request) (string, error) {
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gombadi/honeygot/code/events"
+)
+
+// fakeIMDS answers like the ec2 metadata service with IMDSv2 enforced
+func fakeIMDS(ip *string) *httptest.Server {
+
+	values := map[string]string{
+		"/latest/meta-data/instance-id":                 "i-0123456789abcdef0",
+		"/latest/meta-data/placement/region":            "ap-southeast-2",
+		"/latest/meta-data/placement/availability-zone": "ap-southeast-2a",
+		"/latest/meta-data/ami-id":                      "ami-12345678",
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != "PUT" || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				http.Error(w, "bad token request", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte("token"))
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+			http.Error(w, "no token", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/latest/meta-data/public-ipv4" && *ip != "" {
+			w.Write([]byte(*ip))
+			return
+		}
+		v, ok := values[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(v))
+	}))
+}
+
+func TestMetadataProvider(t *testing.T) {
+
+	ip := "203.0.113.5"
+	srv := fakeIMDS(&ip)
+	defer srv.Close()
+
+	m := newMetadataProvider(MetadataConfig{Endpoint: srv.URL + "/", refresh: time.Hour})
+	m.update()
+
+	want := instanceMeta{
+		PublicIP:   "203.0.113.5",
+		InstanceID: "i-0123456789abcdef0",
+		Region:     "ap-southeast-2",
+		AZ:         "ap-southeast-2a",
+		AMI:        "ami-12345678",
+	}
+	if got := m.get(); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+
+	// a relaunched spot instance loses its public address
+	ip = ""
+	m.update()
+	if got := m.get(); got.PublicIP != "" || got.InstanceID != want.InstanceID {
+		t.Errorf("expected no public ip, got %+v", got)
+	}
+
+	// an unreachable service keeps the last good values
+	srv.Close()
+	m.update()
+	if got := m.get(); got.InstanceID != want.InstanceID {
+		t.Errorf("metadata lost when the service went away, got %+v", got)
+	}
+}
+
+func TestBatcherEnrich(t *testing.T) {
+
+	ip := "203.0.113.5"
+	srv := fakeIMDS(&ip)
+	defer srv.Close()
+
+	b := &batcher{
+		sensor: "sensor-a",
+		tags:   map[string]string{"env": "prod"},
+		meta:   newMetadataProvider(MetadataConfig{Endpoint: srv.URL, refresh: time.Hour}),
+	}
+	b.meta.update()
+
+	ev := &events.AuthEvent{AuthType: "sshPass", DestIP: "10.0.0.1"}
+	ev.UpdateHash()
+	hash := ev.Hash
+	b.enrich(ev)
+
+	if ev.Sensor != "sensor-a" || ev.Tags["env"] != "prod" || ev.InstanceID != "i-0123456789abcdef0" || ev.AZ != "ap-southeast-2a" {
+		t.Errorf("event not enriched: %+v", ev)
+	}
+	if ev.DestIP != "203.0.113.5" {
+		t.Errorf("expected the public ip as DestIP, got %s", ev.DestIP)
+	}
+	if ev.Hash != hash {
+		t.Error("enriching changed the event hash")
+	}
+}
@@ -10,44 +10,60 @@ import (
 	"log"
 	"math/rand"
 	"net"
-	"os"
 	"strings"
 	"sync/atomic"
 	"time"
+
+	"github.com/gombadi/honeygot/code/events"
 )
 
 type MySQLServer struct {
-	b      *batcher // batcher to handle the auth events produced
-	port   string   // port to listen on
+	listenerCounters
+	connTracker
+	b      *batcher       // batcher to handle the auth events produced
+	lc     ListenerConfig // address, port and banner to use
 	socket net.Listener
 }
 
-func startMySQL(port string, b *batcher) (*MySQLServer, error) {
+func init() {
+	registerListener("mysql", "5.5.46-0+deb8u1", newMySQLServer)
+}
 
-	m := &MySQLServer{
-		port: port,
-		b:    b,
+// newMySQLServer creates a new mysql server that is started by calling Start
+func newMySQLServer(lc ListenerConfig, b *batcher) Listener {
+	return &MySQLServer{
+		lc: lc,
+		b:  b,
 	}
+}
+
+// Start starts the mysql server listening
+func (m *MySQLServer) Start() error {
 
 	var err error
-	if port := os.Getenv("HONEYGOT_MYSQLPORT"); port != "" {
-		m.port = port
-	}
 
 	// start the mysql server
-	m.socket, err = net.Listen("tcp", ":"+m.port)
+	m.socket, err = m.lc.listen()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	go m.listenForConn()
 
-	return m, nil
+	return nil
+}
+
+// Name returns the protocol and address of the server
+func (m *MySQLServer) Name() string {
+	return "mysql " + m.lc.addr()
 }
 
 // Close will close the listening server and shutdown the system
-func (m *MySQLServer) Close() {
-	m.socket.Close()
+func (m *MySQLServer) Close() error {
+	if m.socket == nil {
+		return nil
+	}
+	return m.socket.Close()
 }
 
 // listenForConn runs in a goroutine to listen for incoming connections
@@ -56,8 +72,14 @@ func (m *MySQLServer) listenForConn() {
 	for {
 		conn, err := m.socket.Accept()
 		if err == nil {
+			m.addConnection()
+			sess := newClientSession(conn, "mysql")
+			m.trackConn(sess)
 			// handle each incoming request in its own goroutine
-			go m.handleConn(conn)
+			go m.handleConn(sess)
+		} else if errors.Is(err, net.ErrClosed) {
+			// Close was called on shutdown
+			break
 		} else {
 			log.Printf("mysql server socket.Accept failed: %v - mysql server exiting", err)
 			break
@@ -66,27 +88,35 @@ func (m *MySQLServer) listenForConn() {
 }
 
 // handleConn runs in a goroutine and handles an incoming MySQL connection
-func (m *MySQLServer) handleConn(c net.Conn) {
+func (m *MySQLServer) handleConn(c *clientSession) {
 
-	// close the connection to the remote user
-	defer c.Close()
+	defer m.untrackConn(c)
 
-	conn := newConn(c)
+	conn := newConn(c, m.lc.Banner)
 
 	err := conn.Handshake()
 
-	r := &AuthEvent{
-		Time:        fmt.Sprintf("%d", time.Now().Unix()),
-		AuthType:    "mysqlPass",
-		SrcIP:       conn.host,
-		DestIP:      extIP,
-		User:        conn.user,
-		Credentials: conn.credentials,
-		TypeData:    fmt.Sprintf("salt: 0x%x dbname: %s err: %v", conn.salt, conn.db, err),
+	r := c.event("mysqlPass")
+	r.User = conn.user
+	r.Credentials = conn.credentials
+	r.TypeData = fmt.Sprintf("salt: 0x%x dbname: %s err: %v", conn.salt, conn.db, err)
+	d := &events.MySQLDetails{Salt: fmt.Sprintf("%x", conn.salt), Database: conn.db}
+	if err != nil {
+		d.Error = err.Error()
 	}
+	r.Details = d
 
-	r.updateHash()
+	r.UpdateHash()
 	addToBatch(r)
+	m.addAuthEvent()
+
+	// close the connection to the remote user
+	c.Close()
+	if err != nil {
+		c.end(closeReason(err))
+	} else {
+		c.end("auth failed")
+	}
 
 	// FIXME - pull data from the conn and send to batcher
 	//log.Printf("send to batcher - ip: %s user: %s credentials: %s salt: 0x%x db: %s err: %v\n", conn.host, conn.user, conn.credentials, conn.salt, conn.db, err)
@@ -96,6 +126,7 @@ func (m *MySQLServer) handleConn(c net.Conn) {
 type MyConn struct {
 	pkg          *PacketIO
 	c            net.Conn
+	version      string
 	charset      string
 	user         string
 	credentials  string
@@ -116,9 +147,10 @@ func (c *MyConn) Handshake() error {
 	return c.readHandshakeResponse()
 }
 
-func newConn(co net.Conn) *MyConn {
+func newConn(co net.Conn, version string) *MyConn {
 	c := new(MyConn)
 	c.c = co
+	c.version = version
 	c.pkg = NewPacketIO(co)
 	c.pkg.Sequence = 0
 	c.connectionId = atomic.AddUint32(&baseConnId, 1)
@@ -139,7 +171,7 @@ func (c *MyConn) writeInitialHandshake() error {
 	data = append(data, 10)
 
 	//server version[00]
-	data = append(data, ServerVersion...)
+	data = append(data, c.version...)
 	data = append(data, 0)
 
 	//connection id
@@ -356,7 +388,6 @@ const (
 	MinProtocolVersion                 byte   = 10
 	MaxPayloadLen                      int    = 1<<24 - 1
 	TimeFormat                         string = "2006-01-02 15:04:05"
-	ServerVersion                      string = "5.5.46-0+deb8u1"
 	AUTH_NAME                          string = "mysql_native_password"
 	ER_ACCESS_DENIED_STATE             string = "28000"
 	ER_TOO_MANY_USER_CONNECTIONS_STATE string = "42000"
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyHeaderTimeout = 5 * time.Second // time a proxy has to send the header
+	proxyV1MaxLen      = 107             // longest v1 header line including the CRLF
+)
+
+// proxyV2Sig starts every PROXY protocol v2 header
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection that arrived through a proxy. The addresses are the ones
+// the proxy sent in the header
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader // holds anything the client sent after the header
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+func (c *proxyConn) LocalAddr() net.Addr        { return c.local }
+
+// proxyListener reads the PROXY protocol header of every connection from a trusted proxy
+// before handing it on. Headers are read in their own goroutine so a slow proxy does
+// not hold up the other connections
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet // sources that must send a header. Everyone else is used as they are
+
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	err   error // why the listener stopped. Valid once conns is closed
+}
+
+// newProxyListener wraps l so the real client address is used for connections from trusted
+func newProxyListener(l net.Listener, trusted []*net.IPNet) *proxyListener {
+	pl := &proxyListener{
+		Listener: l,
+		trusted:  trusted,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl
+}
+
+// acceptLoop accepts connections until the listener is closed
+func (pl *proxyListener) acceptLoop() {
+	for {
+		c, err := pl.Listener.Accept()
+		if err != nil {
+			pl.err = err
+			close(pl.conns)
+			return
+		}
+		go pl.handshake(c)
+	}
+}
+
+// handshake reads the header of a new connection and queues it for Accept
+func (pl *proxyListener) handshake(c net.Conn) {
+
+	if pl.isTrusted(c.RemoteAddr()) {
+		pc, err := readProxyHeader(c)
+		if err != nil {
+			log.Printf("proxy protocol: dropping connection from %s: %v\n", c.RemoteAddr(), err)
+			c.Close()
+			return
+		}
+		c = pc
+	}
+
+	select {
+	case pl.conns <- c:
+	case <-pl.done:
+		c.Close()
+	}
+}
+
+// isTrusted reports whether addr is allowed to send a header
+func (pl *proxyListener) isTrusted(addr net.Addr) bool {
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range pl.trusted {
+		if n.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept returns the next connection with its header read
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	c, ok := <-pl.conns
+	if !ok {
+		return nil, pl.err
+	}
+	return c, nil
+}
+
+// Close stops the listener and drops connections still sending their header
+func (pl *proxyListener) Close() error {
+	pl.once.Do(func() { close(pl.done) })
+	return pl.Listener.Close()
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header from c
+func readProxyHeader(c net.Conn) (*proxyConn, error) {
+
+	c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	pc := &proxyConn{
+		Conn:   c,
+		r:      bufio.NewReader(c),
+		remote: c.RemoteAddr(),
+		local:  c.LocalAddr(),
+	}
+
+	// only look as far as the first byte so a short v1 header is not held up waiting
+	// for data the client will not send until the server speaks
+	first, err := pc.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case proxyV2Sig[0]:
+		var sig []byte
+		if sig, err = pc.r.Peek(len(proxyV2Sig)); err == nil && !bytes.Equal(sig, proxyV2Sig) {
+			err = errors.New("no PROXY protocol header")
+		}
+		if err == nil {
+			err = pc.readV2()
+		}
+	case 'P':
+		err = pc.readV1()
+	default:
+		err = errors.New("no PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readV1 reads a text header - eg PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func (pc *proxyConn) readV1() error {
+
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		b, err := pc.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if len(line) > proxyV1MaxLen {
+			return errors.New("v1 header too long")
+		}
+	}
+
+	f := strings.Fields(string(line))
+	if len(f) < 2 || f[0] != "PROXY" {
+		return errors.New("no PROXY protocol header")
+	}
+	if f[1] == "UNKNOWN" {
+		// the proxy does not know the client so keep the proxy addresses
+		return nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	src, err := proxyAddr(f[2], f[4])
+	if err != nil {
+		return err
+	}
+	dst, err := proxyAddr(f[3], f[5])
+	if err != nil {
+		return err
+	}
+	pc.remote, pc.local = src, dst
+	return nil
+}
+
+// proxyAddr parses an address from a v1 header
+func proxyAddr(ip, port string) (*net.TCPAddr, error) {
+	a := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if a.IP == nil {
+		return nil, fmt.Errorf("invalid v1 header address %q", ip)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, fmt.Errorf("invalid v1 header port %q", port)
+	}
+	a.Port = p
+	return a, nil
+}
+
+// readV2 reads a binary header
+func (pc *proxyConn) readV2() error {
+
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(pc.r, hdr); err != nil {
+		return err
+	}
+	if hdr[12]>>4 != 2 {
+		return fmt.Errorf("unsupported v2 header version %d", hdr[12]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(pc.r, body); err != nil {
+		return err
+	}
+
+	if hdr[12]&0x0f == 0 {
+		// LOCAL - eg a health check from the proxy itself
+		return nil
+	}
+
+	var ipLen int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// unix sockets and UDP have no client we can report
+		return nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return errors.New("v2 header addresses too short")
+	}
+
+	pc.remote = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	pc.local = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	return nil
+}
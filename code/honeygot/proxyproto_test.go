@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+
+	v2 := func(cmd, fam byte, addrs []byte) string {
+		h := append([]byte(nil), proxyV2Sig...)
+		h = append(h, 0x20|cmd, fam, 0, 0)
+		binary.BigEndian.PutUint16(h[14:], uint16(len(addrs)))
+		return string(append(h, addrs...))
+	}
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+
+	tests := []struct {
+		name   string
+		header string
+		remote string // expected client address. Empty means an error
+		local  string
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 4000 22\r\n", "[2001:db8::1]:4000", "[2001:db8::2]:22"},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "proxy", "proxy"},
+		{"v1 bad", "PROXY TCP4 192.0.2.1\r\n", "", ""},
+		{"v2 tcp4", v2(1, 0x11, v4), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v2 local", v2(0, 0x00, nil), "proxy", "proxy"},
+		{"v2 short", v2(1, 0x11, v4[:6]), "", ""},
+		{"none", "SSH-2.0-Go\r\n", "", ""},
+	}
+
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(tt.header + "hello"))
+			client.Close()
+		}()
+
+		pc, err := readProxyHeader(server)
+		if tt.remote == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			server.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			server.Close()
+			continue
+		}
+
+		remote, local := pc.RemoteAddr().String(), pc.LocalAddr().String()
+		if tt.remote == "proxy" {
+			// net.Pipe addresses
+			tt.remote, tt.local = "pipe", "pipe"
+		}
+		if remote != tt.remote || local != tt.local {
+			t.Errorf("%s: expected %s -> %s, got %s -> %s", tt.name, tt.remote, tt.local, remote, local)
+		}
+		if rest, _ := ioutil.ReadAll(pc); string(rest) != "hello" {
+			t.Errorf("%s: data after the header lost, got %q", tt.name, rest)
+		}
+		server.Close()
+	}
+}
+
+func TestReadProxyHeaderShort(t *testing.T) {
+
+	// a mysql client waits for the server greeting so nothing follows the header
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("PROXY UNKNOWN\r\n"))
+
+	start := time.Now()
+	if _, err := readProxyHeader(server); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("short header took %v to read", d)
+	}
+}
+
+func TestProxyListenerTrust(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, _ := net.ParseCIDR("10.0.0.0/8")
+	pl := newProxyListener(ln, []*net.IPNet{other})
+	defer pl.Close()
+
+	// a client that is not a trusted proxy can not set its address
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ip := conn.RemoteAddr().(*net.TCPAddr).IP.String(); ip != "127.0.0.1" {
+		t.Errorf("untrusted header was used: %s", ip)
+	}
+
+	pl.Close()
+	done := make(chan error)
+	go func() {
+		_, err := pl.Accept()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected an error from a closed listener")
+		}
+	case <-time.After(time.Second):
+		t.Error("Accept did not return after Close")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/gombadi/honeygot/code/events"
+)
+
+// queue overflow policies
+const (
+	dropOldest = "drop-oldest" // throw away the oldest queued event to make room
+	dropNewest = "drop-newest" // throw away the event being added
+	blockFull  = "block"       // make the producer wait for room
+)
+
+// eventQueue is a bounded queue of events between the protocol handlers and the
+// batcher. When it is full the overflow policy decides which event is lost and
+// every lost event is counted so it can be reported
+type eventQueue struct {
+	mu      sync.Mutex
+	notFull *sync.Cond    // signalled when room is made in the queue
+	ready   chan struct{} // has a value while the queue may hold events
+
+	items  []*events.AuthEvent // ring buffer of queued events
+	head   int                 // index of the oldest event
+	count  int                 // number of queued events
+	policy string              // what to do when the queue is full
+	closed bool                // no more events are accepted
+
+	dropped uint64 // events lost since the last call to takeDropped
+}
+
+// newEventQueue creates a queue holding up to capacity events
+func newEventQueue(capacity int, policy string) *eventQueue {
+	q := &eventQueue{
+		items:  make([]*events.AuthEvent, capacity),
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds an event to the queue. It returns false if an event was dropped
+func (q *eventQueue) push(ev *events.AuthEvent) bool {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ok := true
+	for q.count == len(q.items) && !q.closed {
+		switch q.policy {
+		case blockFull:
+			q.notFull.Wait()
+			continue
+		case dropNewest:
+			q.dropped++
+			return false
+		default:
+			// dropOldest makes room by discarding the head
+			q.items[q.head] = nil
+			q.head = (q.head + 1) % len(q.items)
+			q.count--
+			q.dropped++
+			ok = false
+		}
+	}
+
+	if q.closed {
+		q.dropped++
+		return false
+	}
+
+	q.items[(q.head+q.count)%len(q.items)] = ev
+	q.count++
+
+	// wake the batcher without blocking
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return ok
+}
+
+// pop removes and returns the oldest event. It returns nil if the queue is empty
+func (q *eventQueue) pop() *events.AuthEvent {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.count == 0 {
+		return nil
+	}
+	ev := q.items[q.head]
+	q.items[q.head] = nil
+	q.head = (q.head + 1) % len(q.items)
+	q.count--
+	q.notFull.Signal()
+	return ev
+}
+
+// close stops the queue accepting events. Events already queued can still be popped
+// and any producers blocked waiting for room are released
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.notFull.Broadcast()
+	q.mu.Unlock()
+}
+
+// takeDropped returns the number of events dropped since it was last called
+func (q *eventQueue) takeDropped() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	d := q.dropped
+	q.dropped = 0
+	return d
+}
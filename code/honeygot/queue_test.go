@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gombadi/honeygot/code/events"
+)
+
+func queueUsers(q *eventQueue) []string {
+	var u []string
+	for ev := q.pop(); ev != nil; ev = q.pop() {
+		u = append(u, ev.User)
+	}
+	return u
+}
+
+func TestEventQueuePolicies(t *testing.T) {
+
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{dropOldest, []string{"c", "d"}},
+		{dropNewest, []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		q := newEventQueue(2, tt.policy)
+		for _, u := range []string{"a", "b", "c", "d"} {
+			q.push(&events.AuthEvent{User: u})
+		}
+
+		got := queueUsers(q)
+		if len(got) != len(tt.want) || got[0] != tt.want[0] || got[1] != tt.want[1] {
+			t.Errorf("%s: expected %v, got %v", tt.policy, tt.want, got)
+		}
+		if d := q.takeDropped(); d != 2 {
+			t.Errorf("%s: expected 2 dropped, got %d", tt.policy, d)
+		}
+		if d := q.takeDropped(); d != 0 {
+			t.Errorf("%s: dropped count not reset, got %d", tt.policy, d)
+		}
+	}
+}
+
+func TestEventQueueBlock(t *testing.T) {
+
+	q := newEventQueue(1, blockFull)
+	q.push(&events.AuthEvent{User: "a"})
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.push(&events.AuthEvent{User: "b"})
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("push did not block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if ev := q.pop(); ev == nil || ev.User != "a" {
+		t.Fatalf("expected a, got %v", ev)
+	}
+	if ok := <-pushed; !ok {
+		t.Error("blocked push was dropped")
+	}
+
+	// close releases blocked producers and drops anything new
+	go func() {
+		pushed <- q.push(&events.AuthEvent{User: "c"})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	q.close()
+	if ok := <-pushed; ok {
+		t.Error("push after close was accepted")
+	}
+	if got := queueUsers(q); len(got) != 1 || got[0] != "b" {
+		t.Errorf("expected queued b to survive close, got %v", got)
+	}
+	if d := q.takeDropped(); d != 1 {
+		t.Errorf("expected 1 dropped, got %d", d)
+	}
+}
+
+func TestAddToBatchNoQueue(t *testing.T) {
+
+	old := bQueue
+	defer func() { bQueue = old }()
+
+	// events before the batcher starts are thrown away
+	bQueue = nil
+	addToBatch(&events.AuthEvent{AuthType: "sshPass"})
+
+	// and events after it stops are counted as dropped
+	bQueue = newEventQueue(2, dropOldest)
+	bQueue.close()
+	addToBatch(&events.AuthEvent{AuthType: "sshPass"})
+	if d := bQueue.takeDropped(); d != 1 {
+		t.Errorf("expected 1 dropped event, got %d", d)
+	}
+}
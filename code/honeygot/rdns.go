@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rdnsEntry is a cached reverse lookup. Failed lookups are cached with no name so a
+// busy source is not looked up again on every event
+type rdnsEntry struct {
+	name    string
+	expires time.Time
+}
+
+// rdnsCache looks up the names of source addresses in the background. Events only ever
+// get a name that is already cached so the batcher is never held up by dns
+type rdnsCache struct {
+	resolver *net.Resolver
+	workers  int
+	ttl      time.Duration
+	size     int           // most addresses cached
+	timeout  time.Duration // limit on each lookup
+	lookups  chan string   // addresses waiting to be looked up
+
+	mu      sync.Mutex
+	entries map[string]rdnsEntry
+	pending map[string]bool // addresses queued or being looked up
+}
+
+// newRDNSCache creates the reverse lookup cache described by rc
+func newRDNSCache(rc RDNSConfig) *rdnsCache {
+
+	r := &rdnsCache{
+		resolver: net.DefaultResolver,
+		workers:  rc.Workers,
+		ttl:      rc.cacheTTL,
+		size:     rc.CacheSize,
+		timeout:  rc.timeout,
+		lookups:  make(chan string, rc.CacheSize),
+		entries:  make(map[string]rdnsEntry),
+		pending:  make(map[string]bool),
+	}
+
+	if rc.Resolver != "" {
+		// send every query to the configured server
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, rc.Resolver)
+			},
+		}
+	}
+	return r
+}
+
+// Start runs the lookup workers until done is closed
+func (r *rdnsCache) Start(done chan struct{}) {
+	for i := 0; i < r.workers; i++ {
+		go func() {
+			for {
+				select {
+				case ip := <-r.lookups:
+					r.resolve(ip)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// name returns the cached name of ip. An address that is not cached is queued for
+// lookup and "" returned so later events get the name
+func (r *rdnsCache) name(ip string) string {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[ip]
+	if ok && time.Now().Before(e.expires) {
+		return e.name
+	}
+	if r.pending[ip] {
+		return ""
+	}
+
+	select {
+	case r.lookups <- ip:
+		r.pending[ip] = true
+	default:
+		// the workers are behind. The address is tried again on its next event
+	}
+	return ""
+}
+
+// resolve looks up ip and caches the first name found
+func (r *rdnsCache) resolve(ip string) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	names, err := r.resolver.LookupAddr(ctx, ip)
+	cancel()
+
+	var name string
+	if err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.pending, ip)
+	if len(r.entries) >= r.size {
+		r.evict()
+	}
+	r.entries[ip] = rdnsEntry{name: name, expires: time.Now().Add(r.ttl)}
+}
+
+// evict makes room in a full cache by removing the expired entries, or any one entry
+// if none have expired. Called with mu held
+func (r *rdnsCache) evict() {
+
+	now := time.Now()
+	for ip, e := range r.entries {
+		if now.After(e.expires) {
+			delete(r.entries, ip)
+		}
+	}
+	for ip := range r.entries {
+		if len(r.entries) < r.size {
+			break
+		}
+		delete(r.entries, ip)
+	}
+}
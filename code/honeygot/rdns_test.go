@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubDNS answers every PTR query with name and counts the queries it gets
+func stubDNS(t *testing.T, name string, queries *int32) net.PacketConn {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+
+			// the question ends 4 bytes after the name that starts at 12
+			q := 12
+			for q < n && buf[q] != 0 {
+				q += int(buf[q]) + 1
+			}
+			q += 5
+			if q > n {
+				continue
+			}
+
+			resp := append([]byte(nil), buf[:q]...)
+			resp[2], resp[3] = 0x84, 0x00              // response, authoritative
+			binary.BigEndian.PutUint16(resp[6:], 1)    // one answer
+			binary.BigEndian.PutUint16(resp[8:], 0)    // no authority
+			binary.BigEndian.PutUint16(resp[10:], 0)   // no additional
+			resp = append(resp, 0xc0, 12, 0, 12, 0, 1) // name pointer, PTR, IN
+			resp = append(resp, 0, 0, 0x0e, 0x10)      // ttl
+			var rdata []byte
+			for _, l := range strings.Split(name, ".") {
+				rdata = append(rdata, byte(len(l)))
+				rdata = append(rdata, l...)
+			}
+			rdata = append(rdata, 0)
+			resp = append(resp, byte(len(rdata)>>8), byte(len(rdata)))
+			resp = append(resp, rdata...)
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc
+}
+
+func TestRDNSCache(t *testing.T) {
+
+	var queries int32
+	dns := stubDNS(t, "host-1.example.edu", &queries)
+	defer dns.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	r := newRDNSCache(RDNSConfig{Workers: 2, CacheSize: 2, cacheTTL: time.Hour, timeout: time.Second, Resolver: dns.LocalAddr().String()})
+	r.Start(done)
+
+	// the first event for an address never waits for the lookup
+	if n := r.name("192.0.2.1"); n != "" {
+		t.Errorf("expected no name before the lookup, got %q", n)
+	}
+	r.name("192.0.2.1")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for r.name("192.0.2.1") == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := r.name("192.0.2.1"); n != "host-1.example.edu" {
+		t.Fatalf("expected host-1.example.edu, got %q", n)
+	}
+	if q := atomic.LoadInt32(&queries); q != 1 {
+		t.Errorf("expected one query for repeated events, got %d", q)
+	}
+
+	// a full cache drops an entry to make room
+	r.resolve("192.0.2.2")
+	r.resolve("192.0.2.3")
+	if len(r.entries) != 2 {
+		t.Errorf("expected the cache to hold 2 entries, got %d", len(r.entries))
+	}
+}
+
+func TestRDNSCacheExpiry(t *testing.T) {
+
+	r := newRDNSCache(RDNSConfig{Workers: 1, CacheSize: 10, cacheTTL: time.Hour, timeout: time.Second})
+	r.entries["192.0.2.9"] = rdnsEntry{name: "old.example.com", expires: time.Now().Add(-time.Second)}
+
+	if n := r.name("192.0.2.9"); n != "" {
+		t.Errorf("expected an expired name to be dropped, got %q", n)
+	}
+	if !r.pending["192.0.2.9"] {
+		t.Error("expected an expired address to be looked up again")
+	}
+}
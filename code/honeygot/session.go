@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gombadi/honeygot/code/events"
+)
+
+// clientSession wraps a client connection so connect and disconnect events can be sent
+// for it and every auth event on it can carry its id
+type clientSession struct {
+	net.Conn
+	id       string
+	protocol string
+	start    time.Time
+	bytesIn  int64
+	bytesOut int64
+
+	mu     sync.Mutex
+	reason string // set when the sensor closes the connection itself
+	ended  bool
+}
+
+// newClientSession starts a session for a new connection and sends its connect event
+func newClientSession(c net.Conn, protocol string) *clientSession {
+
+	s := &clientSession{
+		Conn:     c,
+		id:       newUUID(),
+		protocol: protocol,
+		start:    time.Now(),
+	}
+
+	r := s.event("connect")
+	r.TypeData = fmt.Sprintf("session: %s", s.id)
+	addToBatch(r)
+
+	return s
+}
+
+// Read counts the bytes sent by the client
+func (s *clientSession) Read(p []byte) (int, error) {
+	n, err := s.Conn.Read(p)
+	atomic.AddInt64(&s.bytesIn, int64(n))
+	return n, err
+}
+
+// Write counts the bytes sent to the client
+func (s *clientSession) Write(p []byte) (int, error) {
+	n, err := s.Conn.Write(p)
+	atomic.AddInt64(&s.bytesOut, int64(n))
+	return n, err
+}
+
+// shutdown closes a connection the sensor gave up waiting for
+func (s *clientSession) shutdown() error {
+	s.mu.Lock()
+	if s.reason == "" {
+		s.reason = "shutdown"
+	}
+	s.mu.Unlock()
+	return s.Conn.Close()
+}
+
+// event creates an event on this session
+func (s *clientSession) event(authType string) *events.AuthEvent {
+	r := newAuthEvent(authType, s.protocol, s.RemoteAddr(), s.LocalAddr())
+	r.SessionID = s.id
+	return r
+}
+
+// end sends the disconnect event for the session. Only the first call does anything
+// and a reason set by shutdown wins over the one passed in
+func (s *clientSession) end(reason string) {
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	if s.reason != "" {
+		reason = s.reason
+	}
+	s.mu.Unlock()
+
+	d := &events.SessionDetails{
+		Duration: time.Since(s.start).Seconds(),
+		BytesIn:  atomic.LoadInt64(&s.bytesIn),
+		BytesOut: atomic.LoadInt64(&s.bytesOut),
+		Reason:   reason,
+	}
+
+	r := s.event("disconnect")
+	r.TypeData = fmt.Sprintf("session: %s duration: %.3fs bytes-in: %d bytes-out: %d reason: %s",
+		s.id, d.Duration, d.BytesIn, d.BytesOut, strconv.QuoteToASCII(reason))
+	r.Details = d
+	addToBatch(r)
+}
+
+// closeReason describes why a handler stopped reading from a connection
+func closeReason(err error) string {
+	if err == nil {
+		return "closed"
+	}
+	return err.Error()
+}
+
+// sessionListener starts a session for every connection it accepts
+type sessionListener struct {
+	net.Listener
+	protocol string
+}
+
+// Accept waits for the next connection and wraps it in a session
+func (l *sessionListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newClientSession(c, l.protocol), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gombadi/honeygot/code/events"
+)
+
+func TestClientSession(t *testing.T) {
+
+	old := bQueue
+	defer func() { bQueue = old }()
+	bQueue = newEventQueue(10, dropNewest)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	s := newClientSession(server, "ssh")
+	go client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	go client.Read(make([]byte, 3))
+	if _, err := s.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	s.end(closeReason(errors.New("EOF")))
+	s.end("closed again")
+
+	var got []*events.AuthEvent
+	for ev := bQueue.pop(); ev != nil; ev = bQueue.pop() {
+		got = append(got, ev)
+	}
+	if len(got) != 2 || got[0].AuthType != "connect" || got[1].AuthType != "disconnect" {
+		t.Fatalf("expected connect and disconnect events, got %+v", got)
+	}
+	for _, ev := range got {
+		if ev.SessionID != s.id || !strings.Contains(ev.TypeData, s.id) {
+			t.Errorf("%s event does not name session %s: %+v", ev.AuthType, s.id, ev)
+		}
+	}
+
+	d, ok := got[1].Details.(*events.SessionDetails)
+	if !ok {
+		t.Fatalf("unexpected disconnect details %T", got[1].Details)
+	}
+	if d.BytesIn != 5 || d.BytesOut != 3 || d.Reason != "EOF" {
+		t.Errorf("unexpected disconnect details %+v", d)
+	}
+}
+
+func TestClientSessionShutdown(t *testing.T) {
+
+	old := bQueue
+	defer func() { bQueue = old }()
+	bQueue = newEventQueue(10, dropNewest)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	s := newClientSession(server, "mysql")
+	s.shutdown()
+	_, err := s.Read(make([]byte, 1))
+	s.end(closeReason(err))
+
+	bQueue.pop()
+	ev := bQueue.pop()
+	if d, ok := ev.Details.(*events.SessionDetails); !ok || d.Reason != "shutdown" {
+		t.Errorf("expected shutdown reason, got %+v", ev.Details)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	signMagic   = "HGSIG1"            // starts every signed batch
+	signSuffix  = ".sig"              // added to the key of signed batches
+	signVersion = "honeygot-batch-v1" // first line of the signed message
+)
+
+// sigHeader is stored in front of a signed batch. Every batch names the hash of the
+// one before it in the same chain so a missing, changed or inserted batch breaks the chain
+type sigHeader struct {
+	Chain string `json:"chain"` // sensor/sink the batch belongs to
+	Seq   uint64 `json:"seq"`   // position in the chain, starting at 1
+	Prev  string `json:"prev"`  // sha256 of the previous signed batch. Empty for the first
+	Hash  string `json:"hash"`  // sha256 of the payload
+	Key   string `json:"key"`   // public key of the sensor
+	Sig   string `json:"sig"`   // ed25519 signature of signedMessage
+}
+
+// signedMessage returns the bytes the signature covers
+func (h *sigHeader) signedMessage() []byte {
+	return []byte(fmt.Sprintf("%s\n%s\n%d\n%s\n%s", signVersion, h.Chain, h.Seq, h.Prev, h.Hash))
+}
+
+// chainState is the part of a chain kept on disk so it carries on across restarts
+type chainState struct {
+	Seq  uint64 `json:"seq"`
+	Prev string `json:"prev"`
+}
+
+// signer signs the batches for one sink and keeps its hash chain
+type signer struct {
+	key       ed25519.PrivateKey
+	chain     string
+	stateFile string
+	state     chainState
+}
+
+// loadSignKey reads the hex encoded ed25519 seed in path, creating a new key if the file
+// does not exist yet
+func loadSignKey(path string) (ed25519.PrivateKey, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err = ioutil.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("created new batch signing key %s\n", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s must hold a %d byte hex encoded ed25519 seed", path, ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// newSigner creates the signer for a chain. The chain position is loaded from stateFile
+func newSigner(key ed25519.PrivateKey, chain, stateFile string) (*signer, error) {
+
+	s := &signer{key: key, chain: chain, stateFile: stateFile}
+
+	data, err := ioutil.ReadFile(stateFile)
+	switch {
+	case os.IsNotExist(err):
+		log.Printf("starting new batch chain %s\n", chain)
+	case err != nil:
+		return nil, err
+	default:
+		if err = json.Unmarshal(data, &s.state); err != nil {
+			return nil, fmt.Errorf("chain state %s: %v", stateFile, err)
+		}
+	}
+	return s, nil
+}
+
+// sign wraps the batch data in a signed header linking it to the previous batch.
+// The signed batch is signMagic | header length | json header | payload
+func (s *signer) sign(b *batch) error {
+
+	sum := sha256.Sum256(b.Data)
+	h := &sigHeader{
+		Chain: s.chain,
+		Seq:   s.state.Seq + 1,
+		Prev:  s.state.Prev,
+		Hash:  hex.EncodeToString(sum[:]),
+		Key:   hex.EncodeToString(s.key.Public().(ed25519.PublicKey)),
+	}
+	h.Sig = hex.EncodeToString(ed25519.Sign(s.key, h.signedMessage()))
+
+	hdr, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	out := make([]byte, 0, len(signMagic)+4+len(hdr)+len(b.Data))
+	out = append(out, signMagic...)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(hdr)))
+	out = append(out, hdr...)
+	out = append(out, b.Data...)
+
+	// save the new chain position before the batch goes anywhere so a crash can
+	// only ever leave a gap in the chain, never a fork
+	next := chainState{Seq: h.Seq}
+	sum = sha256.Sum256(out)
+	next.Prev = hex.EncodeToString(sum[:])
+	if err = s.save(next); err != nil {
+		return err
+	}
+	s.state = next
+
+	b.Data = out
+	b.Key += signSuffix
+	b.ContentType = contentTypeBinary
+	b.ContentEncoding = ""
+	return nil
+}
+
+// save writes the chain state to disk
+func (s *signer) save(st chainState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(s.stateFile+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(s.stateFile+".tmp", s.stateFile)
+}
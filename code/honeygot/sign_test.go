@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openSigned splits a signed batch the way the report tool does
+func openSigned(t *testing.T, data []byte) (*sigHeader, []byte) {
+	data = data[len(signMagic):]
+	n := binary.BigEndian.Uint32(data)
+	h := &sigHeader{}
+	if err := json.Unmarshal(data[4:4+n], h); err != nil {
+		t.Fatal(err)
+	}
+	return h, data[4+n:]
+}
+
+func TestSignerChain(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	key, err := loadSignKey(filepath.Join(dir, "sign.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the key is created once and then reused
+	again, err := loadSignKey(filepath.Join(dir, "sign.key"))
+	if err != nil || !again.Equal(key) {
+		t.Fatalf("key not reloaded: %v", err)
+	}
+
+	state := filepath.Join(dir, "sign.key.s3.chain")
+	s, err := newSigner(key, "sensor/s3", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prev string
+	for i, payload := range []string{"one", "two", "three"} {
+
+		// a restart part way through must carry on the same chain
+		if i == 2 {
+			if s, err = newSigner(key, "sensor/s3", state); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		b := &batch{Key: "k", Data: []byte(payload)}
+		if err := s.sign(b); err != nil {
+			t.Fatal(err)
+		}
+		if b.Key != "k"+signSuffix {
+			t.Errorf("unexpected key %q", b.Key)
+		}
+
+		h, data := openSigned(t, b.Data)
+		if string(data) != payload {
+			t.Errorf("payload %q, expected %q", data, payload)
+		}
+		pub, _ := hex.DecodeString(h.Key)
+		sig, _ := hex.DecodeString(h.Sig)
+		if !ed25519.Verify(ed25519.PublicKey(pub), h.signedMessage(), sig) {
+			t.Errorf("batch %d: bad signature", i)
+		}
+		if h.Seq != uint64(i+1) || h.Prev != prev || h.Chain != "sensor/s3" {
+			t.Errorf("batch %d: unexpected header %+v", i, h)
+		}
+
+		sum := sha256.Sum256(b.Data)
+		prev = hex.EncodeToString(sum[:])
+	}
+}
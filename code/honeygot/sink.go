@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Sink receives completed batches of events
+type Sink interface {
+	Name() string         // name used in log messages and for the spool directory
+	Write(b *batch) error // store a batch under its key
+	Close() error         // release any resources held by the sink
+}
+
+// newSink creates the sink described by sc
+func newSink(sc SinkConfig) (Sink, error) {
+	switch sc.Type {
+	case "s3":
+		return newS3Sink(sc), nil
+	case "file":
+		return newFileSink(sc)
+	case "stdout":
+		return &stdoutSink{name: sc.Name}, nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q", sc.Type)
+}
+
+// s3Sink uploads batches to an s3 bucket
+type s3Sink struct {
+	name   string
+	bucket string // s3 bucket to upload result batches to
+	svc    *s3.S3
+
+	sse          string             // server side encryption - AES256 or aws:kms
+	kmsKeyID     string             // kms key used when sse is aws:kms
+	storageClass string             // s3 storage class for new objects
+	tags         map[string]string  // tags added to every object
+	metadata     map[string]*string // user metadata added to every object
+}
+
+// newS3Sink creates an s3 sink. Session data is pulled from the environment or IAM role
+// unless an endpoint is configured for an s3 compatible store
+func newS3Sink(sc SinkConfig) *s3Sink {
+
+	cfg := aws.NewConfig()
+	if sc.Endpoint != "" {
+		cfg = cfg.WithEndpoint(sc.Endpoint).WithS3ForcePathStyle(true)
+	}
+	if sc.Region != "" {
+		cfg = cfg.WithRegion(sc.Region)
+	}
+
+	s := &s3Sink{
+		name:         sc.Name,
+		bucket:       sc.Bucket,
+		svc:          s3.New(session.New(cfg)),
+		sse:          sc.SSE,
+		kmsKeyID:     sc.KMSKeyID,
+		storageClass: sc.StorageClass,
+		tags:         sc.Tags,
+	}
+	if len(sc.Metadata) > 0 {
+		s.metadata = make(map[string]*string)
+		for k, v := range sc.Metadata {
+			s.metadata[k] = aws.String(v)
+		}
+	}
+	return s
+}
+
+func (s *s3Sink) Name() string { return s.name }
+func (s *s3Sink) Close() error { return nil }
+
+// Write uploads a batch to the s3 bucket
+func (s *s3Sink) Write(b *batch) error {
+
+	params := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket), // Required
+		Key:         aws.String(b.Key),    // Required
+		Body:        bytes.NewReader(b.Data),
+		ContentType: aws.String(b.ContentType),
+	}
+	if b.ContentEncoding != "" {
+		params.ContentEncoding = aws.String(b.ContentEncoding)
+	}
+	if s.sse != "" {
+		params.ServerSideEncryption = aws.String(s.sse)
+	}
+	if s.kmsKeyID != "" {
+		params.SSEKMSKeyId = aws.String(s.kmsKeyID)
+	}
+	if s.storageClass != "" {
+		params.StorageClass = aws.String(s.storageClass)
+	}
+	params.Metadata = s.metadata
+	if len(b.HostKeys) > 0 {
+		params.Metadata = make(map[string]*string)
+		for k, v := range s.metadata {
+			params.Metadata[k] = v
+		}
+		params.Metadata["ssh-host-keys"] = aws.String(strings.Join(b.HostKeys, ", "))
+	}
+
+	req, _ := s.svc.PutObjectRequest(params)
+
+	// this sdk version has no tagging field so the header is set directly. It is signed with the request
+	if tags := s.objectTags(b); tags != "" {
+		req.HTTPRequest.Header.Set("X-Amz-Tagging", tags)
+	}
+
+	err := req.Send()
+	if err != nil {
+		log.Printf("%s sink postResult error: %v\n", s.name, err)
+		return s3Permanent(err)
+	}
+	log.Printf("%s sink pushed to s3: s3://%s/%s\n", s.name, s.bucket, b.Key)
+	return nil
+}
+
+// objectTags returns the url encoded tags for a batch. Batches spooled by older
+// versions do not know their event count or times so only get the configured tags
+func (s *s3Sink) objectTags(b *batch) string {
+
+	v := url.Values{}
+	for k, t := range s.tags {
+		v.Set(k, t)
+	}
+	if b.Sensor != "" {
+		v.Set("sensor", b.Sensor)
+	}
+	if b.Events > 0 {
+		v.Set("events", strconv.Itoa(b.Events))
+		v.Set("first", b.First.Format(time.RFC3339))
+		v.Set("last", b.Last.Format(time.RFC3339))
+	}
+	return v.Encode()
+}
+
+// s3Permanent marks errors where s3 rejected the batch itself, so retrying can never
+// succeed. Auth, throttling, missing bucket and server errors are all worth retrying
+func s3Permanent(err error) error {
+	if rf, ok := err.(awserr.RequestFailure); ok {
+		switch code := rf.StatusCode(); {
+		case code == http.StatusForbidden, code == http.StatusNotFound,
+			code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+		case code >= 400 && code < 500:
+			return &permanentError{err}
+		}
+	}
+	return err
+}
+
+// fileSink writes batches below a local directory using the key as the relative path
+type fileSink struct {
+	name string
+	dir  string
+}
+
+func newFileSink(sc SinkConfig) (*fileSink, error) {
+	if err := os.MkdirAll(sc.Dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileSink{name: sc.Name, dir: sc.Dir}, nil
+}
+
+func (f *fileSink) Name() string { return f.name }
+func (f *fileSink) Close() error { return nil }
+
+// Write stores a batch in the sink directory
+func (f *fileSink) Write(b *batch) error {
+
+	name := filepath.Join(f.dir, filepath.FromSlash(b.Key))
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+
+	// write to a temp file and rename so readers never see half a batch
+	if err := ioutil.WriteFile(name+".tmp", b.Data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	log.Printf("%s sink wrote %s\n", f.name, name)
+	return nil
+}
+
+// stdoutSink writes the events in each batch to standard output
+type stdoutSink struct {
+	name string
+	mu   sync.Mutex
+}
+
+func (s *stdoutSink) Name() string { return s.name }
+func (s *stdoutSink) Close() error { return nil }
+
+// Write copies the batch to stdout
+func (s *stdoutSink) Write(b *batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := os.Stdout.Write(b.Data)
+	return err
+}
+
+// sinkOutput pairs a sink with its own batch and spool so a failing sink does not
+// hold up, or lose data from, any of the others
+type sinkOutput struct {
+	sink      Sink
+	spool     *spool             // write ahead spool for batches. nil if not configured
+	sensor    string             // sensor id used in batch keys
+	keyLayout *template.Template // builds the key each batch is stored under
+	flushCfg  FlushConfig        // when the batch is sent
+	compress  string             // compression applied to each batch
+	keySuffix string             // file type suffix added to each key
+	sealKey   *[32]byte          // public key batches are sealed to. nil to store them as they are
+	signer    *signer            // signs batches into a hash chain. nil if not signing
+
+	buf    bytes.Buffer // events waiting to be sent
+	events int          // number of events in buf
+	first  time.Time    // when the oldest event in buf was added
+	last   time.Time    // when the newest event in buf was added
+}
+
+// add appends an encoded event to the batch and sends the batch if it is now full
+func (o *sinkOutput) add(je []byte) {
+
+	o.last = time.Now()
+	if o.events == 0 {
+		o.first = o.last
+	}
+	o.buf.Write(je)
+	o.events++
+
+	if o.flushCfg.MaxBytes > 0 && o.buf.Len() >= o.flushCfg.MaxBytes {
+		o.flush("max bytes")
+	} else if o.flushCfg.MaxEvents > 0 && o.events >= o.flushCfg.MaxEvents {
+		o.flush("max events")
+	}
+}
+
+// tooOld reports whether the oldest event in the batch has waited longer than the max age
+func (o *sinkOutput) tooOld() bool {
+	return o.events > 0 && o.flushCfg.maxAge > 0 && time.Since(o.first) >= o.flushCfg.maxAge
+}
+
+// flush sends the batch, if there is one, and starts a new one
+func (o *sinkOutput) flush(reason string) {
+
+	if o.events == 0 {
+		return
+	}
+
+	data := make([]byte, o.buf.Len())
+	copy(data, o.buf.Bytes())
+	log.Printf("%s sink sending %d events (%s)\n", o.sink.Name(), o.events, reason)
+
+	events := o.events
+	o.buf.Reset()
+	o.events = 0
+
+	key, err := batchKey(o.keyLayout, newKeyFields(o.sensor, o.first, data))
+	if err != nil {
+		log.Printf("warning - %s sink unable to create batch key: %v. records lost\n", o.sink.Name(), err)
+		return
+	}
+	b, err := newBatch(data, key+o.keySuffix, o.compress)
+	if err != nil {
+		log.Printf("warning - %s sink unable to create batch: %v. records lost\n", o.sink.Name(), err)
+		return
+	}
+	b.Sensor, b.Events, b.First, b.Last = o.sensor, events, o.first.UTC(), o.last.UTC()
+	b.HostKeys = hostKeyFingerprints()
+
+	// seal before the batch reaches the spool so the events are never on disk in the clear
+	if o.sealKey != nil {
+		if err = b.seal(o.sealKey); err != nil {
+			log.Printf("warning - %s sink unable to seal batch: %v. records lost\n", o.sink.Name(), err)
+			return
+		}
+	}
+	if o.signer != nil {
+		if err = o.signer.sign(b); err != nil {
+			log.Printf("warning - %s sink unable to sign batch: %v. records lost\n", o.sink.Name(), err)
+			return
+		}
+	}
+	o.write(b)
+}
+
+// write hands a batch to the spool, or directly to the sink if there is no spool
+func (o *sinkOutput) write(b *batch) {
+
+	if o.spool != nil {
+		// the spool owns the batch once it is on disk and retries until it is uploaded
+		err := o.spool.add(b)
+		if err == nil {
+			return
+		}
+		log.Printf("%s sink spool error: %v - trying direct write\n", o.sink.Name(), err)
+	}
+
+	if err := o.sink.Write(b); err != nil {
+		log.Printf("warning - %s sink batch not spooled. records lost\n", o.sink.Name())
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestS3ObjectTags(t *testing.T) {
+
+	s := &s3Sink{tags: map[string]string{"env": "prod"}}
+	first := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	v, err := url.ParseQuery(s.objectTags(&batch{Sensor: "a", Events: 3, First: first, Last: first.Add(time.Minute)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"env":    "prod",
+		"sensor": "a",
+		"events": "3",
+		"first":  "2016-01-02T03:04:05Z",
+		"last":   "2016-01-02T03:05:05Z",
+	}
+	for k, w := range want {
+		if got := v.Get(k); got != w {
+			t.Errorf("tag %s: expected %q, got %q", k, w, got)
+		}
+	}
+
+	// batches spooled by older versions only get the configured tags
+	if got := s.objectTags(&batch{}); got != "env=prod" {
+		t.Errorf("expected only the configured tags, got %q", got)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolRetryMin  = 5 * time.Second  // first wait after a failed upload
+	spoolRetryMax  = 10 * time.Minute // longest wait between upload attempts
+	spoolTmpExt    = ".tmp"           // extension used while a batch is being written
+	spoolFailedDir = "failed"         // batches that can never be sent are moved here
+	spoolMetaExt   = ".meta"          // extension of the file holding a batch's metadata
+)
+
+// permanentError is returned by a sink when a batch will never be accepted so
+// retrying it would only hold up the batches behind it
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// isPermanent reports whether err means the batch can never be sent
+func isPermanent(err error) bool {
+	var pe *permanentError
+	return errors.As(err, &pe)
+}
+
+// spool is a write ahead directory for batches. Each batch is written to disk before
+// it is uploaded and only removed once the upload has succeeded. Failed uploads are
+// retried with exponential backoff and anything left over is sent on the next start
+type spool struct {
+	dir  string               // directory holding the spooled batches
+	push func(b *batch) error // uploads a batch
+
+	retryMin time.Duration // first wait after a failed upload
+	retryMax time.Duration // longest wait between upload attempts
+
+	mu   sync.Mutex    // only one goroutine sends at a time
+	kick chan struct{} // wakes the retry goroutine when a new batch is spooled
+	quit chan struct{} // closed to stop the retry goroutine
+	wg   sync.WaitGroup
+}
+
+// newSpool creates the spool directory if needed and returns a spool that uses push to
+// upload batches
+func newSpool(dir string, push func(b *batch) error) (*spool, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		dir:      dir,
+		push:     push,
+		retryMin: spoolRetryMin,
+		retryMax: spoolRetryMax,
+		kick:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
+
+	// remove any partly written batches from a crash
+	tmp, _ := filepath.Glob(filepath.Join(dir, "*"+spoolTmpExt))
+	for _, f := range tmp {
+		os.Remove(f)
+	}
+
+	if n := len(s.pending()); n > 0 {
+		log.Printf("spool: %d batches left from last run in %s\n", n, dir)
+	}
+
+	return s, nil
+}
+
+// adopt moves any batches found directly in dir into this spool. It is used to pick
+// up batches spooled before each sink had its own spool directory
+func (s *spool) adopt(dir string) {
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Printf("spool: unable to read %s: %v\n", dir, err)
+		return
+	}
+
+	moved := 0
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), spoolTmpExt) {
+			continue
+		}
+		if err := os.Rename(filepath.Join(dir, fi.Name()), filepath.Join(s.dir, fi.Name())); err != nil {
+			log.Printf("spool: unable to move %s into %s: %v\n", fi.Name(), s.dir, err)
+			continue
+		}
+		moved++
+	}
+	if moved > 0 {
+		log.Printf("spool: moved %d batches from %s into %s\n", moved, dir, s.dir)
+	}
+}
+
+// Start starts the retry goroutine. Batches left from a previous run are sent straight away
+func (s *spool) Start() {
+	s.wg.Add(1)
+	go s.run()
+	s.wake()
+}
+
+// Stop makes a final attempt to send all spooled batches and stops the retry goroutine.
+// Batches that could not be sent stay on disk for the next start
+func (s *spool) Stop() {
+	close(s.quit)
+	s.wg.Wait()
+	if n := s.sendAll(); n > 0 {
+		log.Printf("spool: %d batches remain in %s for next start\n", n, s.dir)
+	}
+}
+
+// add writes a batch to the spool and wakes the retry goroutine to send it
+func (s *spool) add(b *batch) error {
+
+	name := filepath.Join(s.dir, url.PathEscape(b.Key))
+
+	meta, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	// write to temp files and rename so a crash never leaves half a batch. The
+	// metadata goes first so it is always there once the batch can be seen
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{name + spoolMetaExt, meta}, {name, b.Data}} {
+		if err := writeSynced(f.name+spoolTmpExt, f.data); err != nil {
+			return err
+		}
+		if err := os.Rename(f.name+spoolTmpExt, f.name); err != nil {
+			return err
+		}
+	}
+
+	// the renames are only safe once the directory is on disk
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	s.wake()
+	return nil
+}
+
+// writeSynced writes data to a new file and flushes it to disk before returning
+func writeSynced(name string, data []byte) error {
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir flushes the entries of dir to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// load reads a spooled batch and its metadata. Batches spooled before metadata
+// was kept are plain json events stored under the escaped key
+func (s *spool) load(f string) (*batch, error) {
+
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, f))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &batch{}
+	meta, err := ioutil.ReadFile(filepath.Join(s.dir, f+spoolMetaExt))
+	switch {
+	case err == nil:
+		if err = json.Unmarshal(meta, b); err != nil {
+			return nil, err
+		}
+	case os.IsNotExist(err):
+		if b.Key, err = url.PathUnescape(f); err != nil {
+			return nil, err
+		}
+		b.ContentType = contentTypeNDJSON
+	default:
+		return nil, err
+	}
+
+	b.Data = data
+	return b, nil
+}
+
+// wake signals the retry goroutine without blocking
+func (s *spool) wake() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// run runs in a goroutine and sends spooled batches, backing off while uploads fail
+func (s *spool) run() {
+
+	defer s.wg.Done()
+
+	wait := s.retryMin
+	retry := time.NewTimer(wait)
+	retry.Stop()
+	backingOff := false
+
+	for {
+		select {
+		case <-s.quit:
+			retry.Stop()
+			return
+		case <-s.kick:
+			// new batches wait for the next retry while uploads are failing
+			if backingOff {
+				continue
+			}
+		case <-retry.C:
+		}
+
+		if s.sendAll() == 0 {
+			wait = s.retryMin
+			backingOff = false
+			continue
+		}
+
+		// something failed so try again later, waiting longer each time
+		backingOff = true
+		log.Printf("spool: upload failed. retrying in %v\n", wait)
+		retry.Reset(wait)
+		if wait *= 2; wait > s.retryMax {
+			wait = s.retryMax
+		}
+	}
+}
+
+// sendAll tries to upload every spooled batch, oldest first, and returns the number left.
+// It stops at the first transient failure as the remote is most likely unavailable.
+// Batches that can never be sent are moved to the failed directory so they do not
+// block the batches behind them
+func (s *spool) sendAll() int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := s.pending()
+	for i, f := range files {
+
+		b, err := s.load(f)
+		if err != nil {
+			s.fail(f, err)
+			continue
+		}
+
+		if err = s.push(b); err != nil {
+			if isPermanent(err) {
+				s.fail(f, err)
+				continue
+			}
+			return len(files) - i
+		}
+
+		if err = os.Remove(filepath.Join(s.dir, f)); err != nil {
+			log.Printf("spool: unable to remove sent batch %s: %v\n", f, err)
+		}
+		os.Remove(filepath.Join(s.dir, f+spoolMetaExt))
+	}
+	return 0
+}
+
+// fail moves a batch that can never be sent out of the way and logs why
+func (s *spool) fail(f string, reason error) {
+
+	dir := filepath.Join(s.dir, spoolFailedDir)
+	err := os.MkdirAll(dir, 0700)
+	if err == nil {
+		err = os.Rename(filepath.Join(s.dir, f), filepath.Join(dir, f))
+		os.Rename(filepath.Join(s.dir, f+spoolMetaExt), filepath.Join(dir, f+spoolMetaExt))
+	}
+	if err != nil {
+		log.Printf("spool: unable to move failed batch %s out of the way: %v\n", f, err)
+		return
+	}
+	log.Printf("spool: batch %s can not be sent and was moved to %s: %v\n", f, dir, reason)
+}
+
+// pending returns the names of all spooled batches sorted oldest first
+func (s *spool) pending() []string {
+
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("spool: unable to read %s: %v\n", s.dir, err)
+		return nil
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+
+	var names []string
+	for _, fi := range infos {
+		if fi.IsDir() || strings.HasSuffix(fi.Name(), spoolTmpExt) || strings.HasSuffix(fi.Name(), spoolMetaExt) {
+			continue
+		}
+		names = append(names, fi.Name())
+	}
+	return names
+}
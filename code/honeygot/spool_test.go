@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePush records the batches it is given and fails while fail is set
+type fakePush struct {
+	mu    sync.Mutex
+	fail  error
+	calls int
+	keys  []string
+	data  map[string]*batch
+}
+
+func (f *fakePush) push(b *batch) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.fail != nil {
+		return f.fail
+	}
+	if f.data == nil {
+		f.data = make(map[string]*batch)
+	}
+	f.keys = append(f.keys, b.Key)
+	f.data[b.Key] = b
+	return nil
+}
+
+func (f *fakePush) setFail(err error) {
+	f.mu.Lock()
+	f.fail = err
+	f.mu.Unlock()
+}
+
+func (f *fakePush) sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.keys...)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "honeygot-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSpoolOrderAndKeys(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fp := &fakePush{}
+	s, err := newSpool(dir, fp.push)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"2026-10/17/c", "sensor=a b/dt=2026-10-17/%x", "2026-10/17/a"}
+	now := time.Now()
+	for i, k := range keys {
+		if err := s.add(&batch{Key: k, ContentType: contentTypeNDJSON, Data: []byte(k)}); err != nil {
+			t.Fatal(err)
+		}
+		// spread the mtimes so the order does not depend on the file system
+		name := filepath.Join(dir, url.PathEscape(k))
+		mt := now.Add(time.Duration(i-len(keys)) * time.Minute)
+		if err := os.Chtimes(name, mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := s.sendAll(); n != 0 {
+		t.Fatalf("expected nothing left, got %d", n)
+	}
+	if got := fp.sent(); !reflect.DeepEqual(got, keys) {
+		t.Errorf("expected oldest first %v, got %v", keys, got)
+	}
+	for _, k := range keys {
+		if string(fp.data[k].Data) != k {
+			t.Errorf("key %q: data %q", k, fp.data[k].Data)
+		}
+	}
+	if p := s.pending(); len(p) != 0 {
+		t.Errorf("sent batches not removed: %v", p)
+	}
+}
+
+func TestSpoolTmpCleanup(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "half"+spoolTmpExt), []byte("x"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "whole"), []byte("x"), 0600)
+
+	fp := &fakePush{}
+	s, err := newSpool(dir, fp.push)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "half"+spoolTmpExt)); !os.IsNotExist(err) {
+		t.Errorf("partly written batch not removed: %v", err)
+	}
+	if p := s.pending(); !reflect.DeepEqual(p, []string{"whole"}) {
+		t.Errorf("expected the whole batch to be pending, got %v", p)
+	}
+}
+
+func TestSpoolFailures(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fp := &fakePush{}
+	s, err := newSpool(dir, fp.push)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a name that can not be unescaped must not block the good batch behind it
+	bad := filepath.Join(dir, "bad%zz")
+	ioutil.WriteFile(bad, []byte("x"), 0600)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(bad, old, old)
+	s.add(&batch{Key: "good", Data: []byte("x")})
+
+	if n := s.sendAll(); n != 0 {
+		t.Fatalf("expected nothing left, got %d", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, spoolFailedDir, "bad%zz")); err != nil {
+		t.Errorf("bad batch not moved to failed dir: %v", err)
+	}
+
+	// transient errors leave everything in place
+	fp.setFail(errors.New("s3 down"))
+	s.add(&batch{Key: "one", Data: []byte("x")})
+	s.add(&batch{Key: "two", Data: []byte("x")})
+	if n := s.sendAll(); n != 2 {
+		t.Errorf("expected 2 left after transient error, got %d", n)
+	}
+
+	// permanent errors move the batch aside and carry on
+	fp.setFail(&permanentError{errors.New("rejected")})
+	if n := s.sendAll(); n != 0 {
+		t.Errorf("expected 0 left after permanent errors, got %d", n)
+	}
+	failed, _ := filepath.Glob(filepath.Join(dir, spoolFailedDir, "*"))
+	metas, _ := filepath.Glob(filepath.Join(dir, spoolFailedDir, "*"+spoolMetaExt))
+	if len(failed)-len(metas) != 3 {
+		t.Errorf("expected 3 failed batches, got %d", len(failed)-len(metas))
+	}
+}
+
+func TestSpoolBackoff(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fp := &fakePush{fail: errors.New("s3 down")}
+	s, err := newSpool(dir, fp.push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.retryMin = 20 * time.Millisecond
+	s.retryMax = 40 * time.Millisecond
+
+	s.Start()
+	s.add(&batch{Key: "batch", Data: []byte("x")})
+
+	// keep failing for a while then let the upload through
+	time.Sleep(150 * time.Millisecond)
+	fp.mu.Lock()
+	calls := fp.calls
+	fp.mu.Unlock()
+	if calls < 2 {
+		t.Errorf("expected the upload to be retried, got %d calls", calls)
+	}
+	if calls > 10 {
+		t.Errorf("expected retries to back off, got %d calls", calls)
+	}
+
+	fp.setFail(nil)
+	deadline := time.Now().Add(time.Second)
+	for len(fp.sent()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Stop()
+
+	if got := fp.sent(); !reflect.DeepEqual(got, []string{"batch"}) {
+		t.Errorf("expected batch to be sent after retry, got %v", got)
+	}
+	if p := s.pending(); len(p) != 0 {
+		t.Errorf("batch not removed after upload: %v", p)
+	}
+}
+
+func TestSpoolMetadata(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fp := &fakePush{}
+	s, err := newSpool(dir, fp.push)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := newBatch([]byte("{}\n"), "2026-10/17/honeygot-abc", "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.add(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// batches spooled by older versions have no metadata
+	ioutil.WriteFile(filepath.Join(dir, url.PathEscape("2016-1/2/honeygot-abc")), []byte("{}\n"), 0600)
+
+	if n := s.sendAll(); n != 0 {
+		t.Fatalf("expected nothing left, got %d", n)
+	}
+	if got := fp.data[b.Key]; got == nil || got.ContentEncoding != "gzip" || got.ContentType != contentTypeNDJSON {
+		t.Errorf("metadata not kept: %+v", got)
+	}
+	if got := fp.data["2016-1/2/honeygot-abc"]; got == nil || got.ContentEncoding != "" || got.ContentType != contentTypeNDJSON {
+		t.Errorf("legacy batch not sent as plain ndjson: %+v", got)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("spool not empty after send: %d files left", len(files))
+	}
+}
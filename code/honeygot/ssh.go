@@ -1,77 +1,92 @@
 package main
 
 import (
-	"crypto/rand"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/gombadi/honeygot/code/events"
 	"golang.org/x/crypto/ssh"
 )
 
 type SSHServer struct {
-	b      *batcher // batcher to handle the auth events produced
-	port   string   // port to listen on
+	listenerCounters
+	connTracker
+	b      *batcher       // batcher to handle the auth events produced
+	lc     ListenerConfig // address, port and banner to use
 	socket net.Listener
 }
 
-func startSSH(port string, b *batcher) (*SSHServer, error) {
-
-	var err error
+func init() {
+	registerListener("ssh", "SSH-2.0-OpenSSH_6.7p1 Debian-5", newSSHServer)
+}
 
-	s := &SSHServer{
-		port: port,
-		b:    b,
+// newSSHServer creates a new ssh server that is started by calling Start
+func newSSHServer(lc ListenerConfig, b *batcher) Listener {
+	return &SSHServer{
+		lc: lc,
+		b:  b,
 	}
+}
+
+// Start generates the host key and starts the ssh server listening
+func (s *SSHServer) Start() error {
+
+	var err error
 
 	// start the ssh server listening
+	// the auth callbacks are set for each connection so they know its session
 	config := ssh.ServerConfig{
-		PasswordCallback:  authPassword,
-		PublicKeyCallback: authKey,
-		ServerVersion:     "SSH-2.0-OpenSSH_6.7p1 Debian-5",
+		ServerVersion: s.lc.Banner,
 	}
 
-	// generate a new private key each startcso it looks like a new server.
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	// keys from the key dir look like the same server across restarts
+	signers, err := loadHostKeys(s.lc.KeyDir)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	privateKeyDer := x509.MarshalPKCS1PrivateKey(privateKey)
-	privateKeyBlock := pem.Block{
-		Type:    "RSA PRIVATE KEY",
-		Headers: nil,
-		Bytes:   privateKeyDer,
+	if s.lc.KeyDir == "" {
+		log.Printf("warning - %s has no keyDir. new host keys are used on every start\n", s.Name())
 	}
-
-	hostPrivateKeySigner, err := ssh.ParsePrivateKey(pem.EncodeToMemory(&privateKeyBlock))
-	if err != nil {
-		return nil, err
+	for _, signer := range signers {
+		config.AddHostKey(signer)
+		fp := hostKeyFingerprint(signer.PublicKey())
+		log.Printf("%s host key %s\n", s.Name(), fp)
+		addSensorHostKey(fp)
 	}
-	config.AddHostKey(hostPrivateKeySigner)
 
-	s.socket, err = net.Listen("tcp", ":"+s.port)
+	s.socket, err = s.lc.listen()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	go s.listenForConn(config)
 
-	return s, nil
+	return nil
+}
+
+// Name returns the protocol and address of the server
+func (s *SSHServer) Name() string {
+	return "ssh " + s.lc.addr()
 }
 
 // Close will close the listening server and shutdown the system
-func (s *SSHServer) Close() {
-	s.socket.Close()
+func (s *SSHServer) Close() error {
+	if s.socket == nil {
+		return nil
+	}
+	return s.socket.Close()
 }
 
 // listenForConn runs in a goroutine to listen for incoming connections
@@ -80,8 +95,14 @@ func (s *SSHServer) listenForConn(config ssh.ServerConfig) {
 	for {
 		conn, err := s.socket.Accept()
 		if err == nil {
+			s.addConnection()
+			sess := newClientSession(conn, "ssh")
+			s.trackConn(sess)
 			// handle each incoming request in its own goroutine
-			go s.handleSSH(conn, config)
+			go s.handleSSH(sess, config)
+		} else if errors.Is(err, net.ErrClosed) {
+			// Close was called on shutdown
+			break
 		} else {
 			log.Printf("ssh server socket.Accept failed: %v - ssh server exiting\n", err)
 			break
@@ -90,52 +111,234 @@ func (s *SSHServer) listenForConn(config ssh.ServerConfig) {
 }
 
 // handleSSH runs in a goroutine and handles an incoming SSH connection
-func (s *SSHServer) handleSSH(conn net.Conn, config ssh.ServerConfig) {
+func (s *SSHServer) handleSSH(cs *clientSession, config ssh.ServerConfig) {
+
+	defer s.untrackConn(cs)
 
-	_, _, _, err := ssh.NewServerConn(conn, &config)
+	sess := &sshConn{clientSession: cs, kex: &kexSniffer{Conn: cs}}
+
+	config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		return s.authPassword(sess, conn, password)
+	}
+	config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		return s.authKey(sess, conn, key)
+	}
+	config.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		return s.authKbdInt(sess, conn, client)
+	}
+
+	// every auth request, including none, is logged in the order the client sends them
+	var clientVersion string
+	var attempts []events.SSHAuthAttempt
+	config.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+		clientVersion = string(conn.ClientVersion())
+		attempts = append(attempts, events.SSHAuthAttempt{Method: method, User: conn.User()})
+	}
+
+	_, _, _, err := ssh.NewServerConn(sess.kex, &config)
 	if err == nil {
 		// this should never happen and if it does we need to shutdown the system
 		log.Fatal("ssh server error: successful login. Shutting down system\n")
 	}
+	cs.Close()
+	s.summary(sess, clientVersion, attempts, err)
+	cs.end(closeReason(err))
+}
+
+// summary records the auth methods and users a client tried, in order, and how the
+// connection ended. The method order is a good fingerprint of the client software
+func (s *SSHServer) summary(sess *sshConn, clientVersion string, attempts []events.SSHAuthAttempt, err error) {
+
+	d := &events.SSHSummaryDetails{
+		ClientVersion: clientVersion,
+		KexInit:       sess.kex.kexInit(),
+		Attempts:      attempts,
+		Methods:       make(map[string]int),
+		Duration:      time.Since(sess.start).Seconds(),
+	}
+	if err != nil {
+		d.Error = err.Error()
+	}
+
+	var methods, users []string
+	for _, a := range attempts {
+		d.Methods[a.Method]++
+		methods = append(methods, a.Method)
+		users = append(users, strconv.QuoteToASCII(a.User))
+	}
+
+	r := sess.event("sshSummary")
+	if len(attempts) > 0 {
+		r.User = attempts[len(attempts)-1].User
+	}
+	r.TypeData = fmt.Sprintf("client-version: %s methods: %s users: %s attempts: %d duration: %.3fs error: %s",
+		strconv.QuoteToASCII(clientVersion), strings.Join(methods, ","), strings.Join(users, ","),
+		len(attempts), d.Duration, strconv.QuoteToASCII(d.Error))
+	r.Details = d
+	addToBatch(r)
+}
+
+// sshConn is an ssh session along with the algorithms the client offered
+type sshConn struct {
+	*clientSession
+	kex *kexSniffer
+}
+
+// event creates an event on the connection carrying the client's HASSH fingerprint
+func (c *sshConn) event(authType string) *events.AuthEvent {
+	r := c.clientSession.event(authType)
+	r.HASSH = c.kex.hassh()
+	return r
 }
 
 var errAuthenticationFailed = errors.New("Invalid credentials. Please try again")
 
 // authPassword records any incoming request trying to auth with a username/password
-func authPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+func (s *SSHServer) authPassword(sess *sshConn, conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
 
-	r := &AuthEvent{
-		Time:        fmt.Sprintf("%d", time.Now().Unix()),
-		AuthType:    "sshPass",
-		SrcIP:       strings.Split(conn.RemoteAddr().String(), ":")[0],
-		DestIP:      extIP,
-		User:        conn.User(),
-		TypeData:    fmt.Sprintf("client-version: %s", strconv.QuoteToASCII(string(conn.ClientVersion()))),
-		Credentials: strconv.QuoteToASCII(string(password)),
-	}
+	r := sess.event("sshPass")
+	r.User = conn.User()
+	r.TypeData = fmt.Sprintf("client-version: %s", strconv.QuoteToASCII(string(conn.ClientVersion())))
+	r.Credentials = strconv.QuoteToASCII(string(password))
+	r.Details = &events.SSHDetails{ClientVersion: string(conn.ClientVersion()), KexInit: sess.kex.kexInit()}
 
 	addToBatch(r)
+	s.addAuthEvent()
 
 	return nil, errAuthenticationFailed
 }
 
 // authKey records any incoming request trying to auth with an ssh key
-func authKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+func (s *SSHServer) authKey(sess *sshConn, conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 
-	r := &AuthEvent{
-		Time:     fmt.Sprintf("%d", time.Now().Unix()),
-		AuthType: "sshKey",
-		SrcIP:    strings.Split(conn.RemoteAddr().String(), ":")[0],
-		DestIP:   extIP,
-		User:     conn.User(),
-		TypeData: fmt.Sprintf("ssh-key-type: %s client-version: %s", key.Type(), strconv.QuoteToASCII(string(conn.ClientVersion()))),
+	d := &events.SSHDetails{
+		ClientVersion: string(conn.ClientVersion()),
+		KexInit:       sess.kex.kexInit(),
+		KeyType:       key.Type(),
+		PublicKey:     strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		Fingerprint:   ssh.FingerprintSHA256(key),
+		KeyBits:       keyBits(key),
+		Cert:          certDetails(key),
 	}
 
+	r := sess.event("sshKey")
+	r.User = conn.User()
+	r.TypeData = keyTypeData(d)
+	r.Details = d
+
 	h := sha256.New()
 	h.Write(key.Marshal())
 	r.Credentials = base64.StdEncoding.EncodeToString(h.Sum(nil))
 
 	addToBatch(r)
+	s.addAuthEvent()
+
+	return nil, errAuthenticationFailed
+}
+
+// keyTypeData describes an offered key for v1 events, which have no details
+func keyTypeData(d *events.SSHDetails) string {
+
+	td := fmt.Sprintf("ssh-key-type: %s client-version: %s fingerprint: %s key-bits: %d public-key: %s",
+		d.KeyType, strconv.QuoteToASCII(d.ClientVersion), d.Fingerprint, d.KeyBits, strconv.QuoteToASCII(d.PublicKey))
+
+	if c := d.Cert; c != nil {
+		td += fmt.Sprintf(" cert-type: %s cert-key-id: %s cert-serial: %d cert-principals: %s cert-valid-after: %s cert-valid-before: %s cert-ca: %s %s",
+			c.Type, strconv.QuoteToASCII(c.KeyID), c.Serial, strconv.QuoteToASCII(strings.Join(c.Principals, ",")),
+			c.ValidAfter, c.ValidBefore, c.CAKeyType, c.CAFingerprint)
+	}
+	return td
+}
+
+// keyBits returns the size of an offered key, or of the key in a certificate, or 0 if
+// it is not known
+func keyBits(key ssh.PublicKey) int {
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	if ck, ok := key.(ssh.CryptoPublicKey); ok {
+		switch k := ck.CryptoPublicKey().(type) {
+		case *rsa.PublicKey:
+			return k.N.BitLen()
+		case *ecdsa.PublicKey:
+			return k.Curve.Params().BitSize
+		case *dsa.PublicKey:
+			return k.P.BitLen()
+		case ed25519.PublicKey:
+			return 256
+		}
+	}
+
+	// security keys do not give up their crypto key
+	switch key.Type() {
+	case ssh.KeyAlgoSKED25519, ssh.KeyAlgoSKECDSA256:
+		return 256
+	}
+	return 0
+}
+
+// certDetails describes an offered certificate or returns nil for a plain key
+func certDetails(key ssh.PublicKey) *events.SSHCert {
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil
+	}
+
+	c := &events.SSHCert{
+		Type:          "user",
+		KeyID:         cert.KeyId,
+		Serial:        cert.Serial,
+		Principals:    cert.ValidPrincipals,
+		ValidAfter:    certTime(cert.ValidAfter),
+		ValidBefore:   certTime(cert.ValidBefore),
+		CAKeyType:     cert.SignatureKey.Type(),
+		CAFingerprint: ssh.FingerprintSHA256(cert.SignatureKey),
+	}
+	if cert.CertType == ssh.HostCert {
+		c.Type = "host"
+	}
+	return c
+}
+
+// certTime formats a certificate validity time, which may be forever
+func certTime(t uint64) string {
+	if t > math.MaxInt64 {
+		return "forever"
+	}
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
+
+// authKbdInt asks each keyboard-interactive prompt in its own round, as PAM does, and
+// records every answer along with the answers given so far
+func (s *SSHServer) authKbdInt(sess *sshConn, conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+
+	var prompts []events.PromptAnswer
+	for _, prompt := range s.lc.Prompts {
+
+		answers, err := client("", "", []string{prompt}, []bool{false})
+		if err != nil {
+			return nil, err
+		}
+		if len(answers) != 1 {
+			return nil, errAuthenticationFailed
+		}
+		prompts = append(prompts, events.PromptAnswer{Prompt: prompt, Answer: answers[0]})
+
+		r := sess.event("sshKbdInt")
+		r.User = conn.User()
+		r.TypeData = fmt.Sprintf("prompt: %s client-version: %s", strconv.QuoteToASCII(prompt), strconv.QuoteToASCII(string(conn.ClientVersion())))
+		r.Credentials = strconv.QuoteToASCII(answers[0])
+		r.Details = &events.SSHDetails{
+			ClientVersion: string(conn.ClientVersion()),
+			KexInit:       sess.kex.kexInit(),
+			Prompts:       append([]events.PromptAnswer(nil), prompts...),
+		}
+
+		addToBatch(r)
+		s.addAuthEvent()
+	}
 
 	return nil, errAuthenticationFailed
 }
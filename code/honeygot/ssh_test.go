@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gombadi/honeygot/code/events"
+	"golang.org/x/crypto/ssh"
+)
+
+// startTestSSH starts an ssh listener on a free local port
+func startTestSSH(t *testing.T, prompts ...string) *SSHServer {
+
+	s := newSSHServer(ListenerConfig{
+		Protocol: "ssh",
+		Address:  "127.0.0.1",
+		Port:     "0",
+		Network:  "tcp",
+		Banner:   "SSH-2.0-OpenSSH_6.7p1 Debian-5",
+		Prompts:  prompts,
+	}, nil).(*SSHServer)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// stopTestSSH shuts the listener down the way main does and waits for its handlers,
+// so nothing is sent to bQueue once a test restores it
+func stopTestSSH(s *SSHServer) {
+	s.Close()
+	s.Drain(time.Now().Add(2 * time.Second))
+}
+
+func TestSSHKeyboardInteractive(t *testing.T) {
+
+	old := bQueue
+	defer func() { bQueue = old }()
+	bQueue = newEventQueue(10, dropNewest)
+
+	s := startTestSSH(t, "Password: ", "Verification code: ")
+	defer stopTestSSH(s)
+
+	var asked []string
+	answers := map[string]string{"Password: ": "hunter2", "Verification code: ": "123456"}
+	_, err := ssh.Dial("tcp", s.socket.Addr().String(), &ssh.ClientConfig{
+		User: "root",
+		Auth: []ssh.AuthMethod{ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			var a []string
+			for _, q := range questions {
+				asked = append(asked, q)
+				a = append(a, answers[q])
+			}
+			return a, nil
+		})},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		t.Fatal("expected the login to fail")
+	}
+	if len(asked) != 2 || asked[0] != "Password: " || asked[1] != "Verification code: " {
+		t.Errorf("expected a password then a verification code prompt, got %q", asked)
+	}
+
+	var got []*events.AuthEvent
+	for ev := bQueue.pop(); ev != nil; ev = bQueue.pop() {
+		if ev.AuthType == "sshKbdInt" {
+			got = append(got, ev)
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected an event for each answer, got %+v", got)
+	}
+	if got[0].User != "root" || got[0].Credentials != `"hunter2"` || got[1].Credentials != `"123456"` {
+		t.Errorf("unexpected credentials %q %q", got[0].Credentials, got[1].Credentials)
+	}
+	d, ok := got[1].Details.(*events.SSHDetails)
+	if !ok {
+		t.Fatalf("unexpected details %T", got[1].Details)
+	}
+	want := []events.PromptAnswer{{Prompt: "Password: ", Answer: "hunter2"}, {Prompt: "Verification code: ", Answer: "123456"}}
+	if len(d.Prompts) != 2 || d.Prompts[0] != want[0] || d.Prompts[1] != want[1] {
+		t.Errorf("expected prompts %+v, got %+v", want, d.Prompts)
+	}
+	if d = got[0].Details.(*events.SSHDetails); len(d.Prompts) != 1 {
+		t.Errorf("expected the first event to hold one answer, got %+v", d.Prompts)
+	}
+}
+
+func TestSSHSummary(t *testing.T) {
+
+	old := bQueue
+	defer func() { bQueue = old }()
+	bQueue = newEventQueue(20, dropNewest)
+
+	s := startTestSSH(t, "Password: ")
+	defer stopTestSSH(s)
+
+	_, err := ssh.Dial("tcp", s.socket.Addr().String(), &ssh.ClientConfig{
+		User: "admin",
+		Auth: []ssh.AuthMethod{
+			ssh.Password("admin"),
+			ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				return make([]string, len(questions)), nil
+			}),
+		},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		t.Fatal("expected the login to fail")
+	}
+
+	// the summary is sent once the server side of the connection has closed
+	stopTestSSH(s)
+	var summary *events.AuthEvent
+	for ev := bQueue.pop(); ev != nil; ev = bQueue.pop() {
+		if ev.AuthType == "sshSummary" {
+			summary = ev
+		}
+	}
+	if summary == nil {
+		t.Fatal("no sshSummary event")
+	}
+
+	d, ok := summary.Details.(*events.SSHSummaryDetails)
+	if !ok {
+		t.Fatalf("unexpected details %T", summary.Details)
+	}
+	want := []string{"none", "password", "keyboard-interactive"}
+	if len(d.Attempts) != len(want) {
+		t.Fatalf("expected attempts %v, got %+v", want, d.Attempts)
+	}
+	for i, a := range d.Attempts {
+		if a.Method != want[i] || a.User != "admin" {
+			t.Errorf("attempt %d: expected %s by admin, got %+v", i, want[i], a)
+		}
+	}
+	if d.Methods["password"] != 1 || d.Error == "" || d.ClientVersion == "" || d.KexInit == nil || len(d.KexInit.Kex) == 0 {
+		t.Errorf("unexpected summary %+v", d)
+	}
+	if summary.HASSH != hassh(d.KexInit) || len(summary.HASSH) != 32 {
+		t.Errorf("unexpected hassh %q", summary.HASSH)
+	}
+	if !strings.Contains(summary.TypeData, "methods: none,password,keyboard-interactive ") {
+		t.Errorf("unexpected TypeData %q", summary.TypeData)
+	}
+}
+
+func TestSSHKeyAuth(t *testing.T) {
+
+	old := bQueue
+	defer func() { bQueue = old }()
+	bQueue = newEventQueue(20, dropNewest)
+
+	s := startTestSSH(t, "Password: ")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSigner, _ := ssh.NewSignerFromKey(rsaKey)
+
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	caSigner, _ := ssh.NewSignerFromKey(caKey)
+	_, userKey, _ := ed25519.GenerateKey(rand.Reader)
+	userSigner, _ := ssh.NewSignerFromKey(userKey)
+	cert := &ssh.Certificate{
+		Key:             userSigner.PublicKey(),
+		Serial:          42,
+		CertType:        ssh.UserCert,
+		KeyId:           "deploy@build",
+		ValidPrincipals: []string{"root", "deploy"},
+		ValidAfter:      1700000000,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err = cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatal(err)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, userSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ssh.Dial("tcp", s.socket.Addr().String(), &ssh.ClientConfig{
+		User:            "deploy",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(rsaSigner, certSigner)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+
+	stopTestSSH(s)
+
+	got := make(map[string]*events.SSHDetails)
+	typeData := make(map[string]string)
+	for ev := bQueue.pop(); ev != nil; ev = bQueue.pop() {
+		if ev.AuthType == "sshKey" {
+			d := ev.Details.(*events.SSHDetails)
+			got[d.KeyType] = d
+			typeData[d.KeyType] = ev.TypeData
+		}
+	}
+
+	d := got[ssh.KeyAlgoRSA]
+	if d == nil {
+		t.Fatalf("no event for the rsa key, got %+v", got)
+	}
+	if d.Fingerprint != ssh.FingerprintSHA256(rsaSigner.PublicKey()) || d.KeyBits != 1024 || d.Cert != nil {
+		t.Errorf("unexpected rsa key details %+v", d)
+	}
+	if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(d.PublicKey)); err != nil || ssh.FingerprintSHA256(pub) != d.Fingerprint {
+		t.Errorf("public key %q does not match the fingerprint: %v", d.PublicKey, err)
+	}
+	// v1 events only keep TypeData so the key must be in there too
+	for _, part := range []string{"fingerprint: " + d.Fingerprint, "key-bits: 1024", "public-key: " + strconv.Quote(d.PublicKey)} {
+		if !strings.Contains(typeData[ssh.KeyAlgoRSA], part) {
+			t.Errorf("expected %q in %q", part, typeData[ssh.KeyAlgoRSA])
+		}
+	}
+
+	d = got[ssh.CertAlgoED25519v01]
+	if d == nil {
+		t.Fatalf("no event for the certificate, got %+v", got)
+	}
+	want := &events.SSHCert{
+		Type:          "user",
+		KeyID:         "deploy@build",
+		Serial:        42,
+		Principals:    []string{"root", "deploy"},
+		ValidAfter:    "2023-11-14T22:13:20Z",
+		ValidBefore:   "forever",
+		CAKeyType:     ssh.KeyAlgoED25519,
+		CAFingerprint: ssh.FingerprintSHA256(caSigner.PublicKey()),
+	}
+	if d.KeyBits != 256 || !reflect.DeepEqual(d.Cert, want) {
+		t.Errorf("expected %d bits and %+v, got %d and %+v", 256, want, d.KeyBits, d.Cert)
+	}
+	for _, part := range []string{"cert-key-id: \"deploy@build\"", "cert-serial: 42", "cert-principals: \"root,deploy\"", "cert-valid-before: forever"} {
+		if !strings.Contains(typeData[ssh.CertAlgoED25519v01], part) {
+			t.Errorf("expected %q in %q", part, typeData[ssh.CertAlgoED25519v01])
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// legacyKeyLayout is the key layout honeygot used before layouts could be configured
+const legacyKeyLayout = `{{.Time.Year}}-{{printf "%d" .Time.Month}}/{{.Time.Day}}/honeygot-{{.Hash}}`
+
+// keyFields are the values available to a key layout template. Must match honeygot
+type keyFields struct {
+	Sensor string
+	Time   time.Time
+	Date   string
+	Hour   string
+	Hash   string
+	ID     string
+}
+
+// layoutKey renders the layout for a batch from sensor at t. hash is used for both Hash and ID
+func layoutKey(t *template.Template, sensor string, ts time.Time, hash string) (string, error) {
+
+	var b bytes.Buffer
+	err := t.Execute(&b, keyFields{
+		Sensor: sensor,
+		Time:   ts,
+		Date:   ts.Format("2006-01-02"),
+		Hour:   ts.Format("15"),
+		Hash:   hash,
+		ID:     hash,
+	})
+	return b.String(), err
+}
+
+// dayPrefix returns the longest bucket prefix shared by every key the layout can produce
+// for sensor on the day starting at day. An empty sensor means any sensor. Anything after
+// the last / is dropped
+func dayPrefix(t *template.Template, sensor string, day time.Time) (string, error) {
+
+	// render the first and last batch of the day with different hashes and keep what they share
+	s1, s2 := sensor, sensor
+	if sensor == "" {
+		s1, s2 = "a", "b"
+	}
+	first, err := layoutKey(t, s1, day, "0")
+	if err != nil {
+		return "", err
+	}
+	last, err := layoutKey(t, s2, day.Add(24*time.Hour-time.Second), "1")
+	if err != nil {
+		return "", err
+	}
+
+	i := 0
+	for i < len(first) && i < len(last) && first[i] == last[i] {
+		i++
+	}
+	return first[:strings.LastIndex(first[:i], "/")+1], nil
+}
+
+// dayPrefixes returns the bucket prefixes holding the batches for the given sensors on a day.
+// The layout must put the date before anything that changes during the day
+func dayPrefixes(layout string, sensors []string, day time.Time) ([]string, error) {
+
+	t, err := template.New("key").Parse(layout)
+	if err != nil {
+		return nil, err
+	}
+	if len(sensors) == 0 {
+		sensors = []string{""}
+	}
+
+	var prefixes []string
+	for _, s := range sensors {
+		p, err := dayPrefix(t, s, day)
+		if err != nil {
+			return nil, err
+		}
+
+		// a prefix that is the same the next day would read far more than one day
+		next, err := dayPrefix(t, s, day.AddDate(0, 0, 1))
+		if err != nil {
+			return nil, err
+		}
+		if p == next {
+			if s == "" {
+				return nil, fmt.Errorf("layout %q can not select a day. Does it need -sensor?", layout)
+			}
+			return nil, fmt.Errorf("layout %q does not start with the date", layout)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
@@ -7,10 +7,14 @@ to AWS Lambda. It is then run and the output is shown in Cloudwatch logs
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,6 +22,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/gombadi/honeygot/code/events"
+	"github.com/gombadi/honeygot/code/geoip"
 )
 
 const (
@@ -29,6 +35,13 @@ var region string    // AWS region to test in
 var s3bucket string  // s3 bucket to read the results from
 var snsreport string // s3 bucket to write the report to
 var prefix string    // s3 bucket prefix to read the results from. i.e. what days results to read
+var layout string    // key layout the sensors store batches with
+var sensors string   // comma separated sensor ids to report on
+var sealKeyFile string
+var sensorKeysFile string
+var geoipFiles string // comma separated mmdb databases
+var geo *geoip.DB     // locates sources the sensors did not. nil if -geoip is not set
+var genKey bool
 var debug bool
 
 func main() {
@@ -40,35 +53,89 @@ func main() {
 	flag.StringVar(&region, "region", "", "AWS region to use")
 	flag.StringVar(&s3bucket, "s3bucket", "", "AWS s3 Bucket to read results from")
 	flag.StringVar(&snsreport, "snsreport", "", "AWS sns arn topic to publish report to")
-	flag.StringVar(&prefix, "prefix", "", "s3 Bucket prefix to use")
+	flag.StringVar(&prefix, "prefix", "", "s3 Bucket prefix to use. Overrides -layout")
+	flag.StringVar(&layout, "layout", legacyKeyLayout, "Key layout the sensors store batches with")
+	flag.StringVar(&sensors, "sensor", "", "Comma separated sensor ids to report on when the layout starts with the sensor")
 	flag.BoolVar(&debug, "debug", false, "Print report local instead of via SNS")
+	flag.StringVar(&sealKeyFile, "sealkey", "", "File holding the private key to open sealed batches")
+	flag.BoolVar(&genKey, "gen-seal-key", false, "Print a new key pair for sealing batches and exit")
+	flag.StringVar(&sensorKeysFile, "sensorkeys", "", "File of trusted \"sensor publickey\" lines to check batch signatures against")
+	flag.StringVar(&geoipFiles, "geoip", "", "Comma separated .mmdb country, city or ASN databases to locate sources the sensors did not")
 	flag.Parse()
 
+	if genKey {
+		if err := genSealKey(); err != nil {
+			fmt.Printf("error generating key: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if sealKeyFile != "" {
+		var err error
+		if sealPrivKey, err = loadSealKey(sealKeyFile); err != nil {
+			fmt.Printf("error loading seal key: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	// get report date which is yesterday
 	yr, mth, day := time.Now().UTC().AddDate(0, 0, -1).Date()
 
+	prefixes := []string{prefix}
 	if prefix == "" {
-		prefix = fmt.Sprintf("%v-%v/%v/", yr, int(mth), day)
+		var sl []string
+		if sensors != "" {
+			sl = strings.Split(sensors, ",")
+		}
+		var err error
+		prefixes, err = dayPrefixes(layout, sl, time.Date(yr, mth, day, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			fmt.Printf("error with key layout: %v\n", err)
+			os.Exit(1)
+		}
 	}
+	if geoipFiles != "" {
+		var err error
+		if geo, err = geoip.OpenDB(strings.Split(geoipFiles, ",")); err != nil {
+			fmt.Printf("error opening geoip database: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if sensorKeysFile != "" {
+		var err error
+		if batchCheck.sensors, err = loadSensorKeys(sensorKeysFile); err != nil {
+			fmt.Printf("error loading sensor keys: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	sess := session.New()
 	s3svc := s3.New(sess)
 
-	// currently only get the first 999 files in the s3 bucket
-	params := &s3.ListObjectsInput{
-		Bucket:  aws.String(s3bucket),
-		MaxKeys: aws.Int64(999),
-		Prefix:  aws.String(prefix),
-	}
-	listObjResp, err := s3svc.ListObjects(params)
-	if err != nil {
-		fmt.Printf("aws err - listobjects: %v\n", err)
-		os.Exit(1)
+	var s3Files []*s3.Object
+	for _, p := range prefixes {
+		if debug == true {
+			fmt.Printf("debug: listing s3 prefix %s\n", p)
+		}
+		params := &s3.ListObjectsInput{
+			Bucket: aws.String(s3bucket),
+			Prefix: aws.String(p),
+		}
+		err := s3svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, last bool) bool {
+			s3Files = append(s3Files, page.Contents...)
+			return true
+		})
+		if err != nil {
+			fmt.Printf("aws err - listobjects: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
 	fmt.Printf("Time: received s3 file list - %v\n", time.Since(t1).String())
 	t2 := time.Now()
 
-	aeMap, err := fillMap(s3svc, listObjResp.Contents)
+	aeMap, err := fillMap(s3svc, s3Files)
 	if err != nil {
 		fmt.Printf("error reading data from s3: %v\n", err)
 		os.Exit(1)
@@ -78,13 +145,14 @@ func main() {
 	t3 := time.Now()
 
 	report := produceReport(aeMap)
+	report.WriteString(batchCheck.report())
 
 	fmt.Printf("Time: report produced - %v\n", time.Since(t3).String())
 
 	report.WriteString(fmt.Sprintf("\n========\nReport Stats:\nTime to get s3 file list: %v\n", t2.Sub(t1).String()))
 	report.WriteString(fmt.Sprintf("Time to download all s3 files: %v\nTime to produce report: %v\n\n", t3.Sub(t2).String(), time.Since(t3).String()))
 
-	ro := fmt.Sprintf("Final Report:\nNumber of files processed: %d\n\n%s\n", len(listObjResp.Contents), report.String())
+	ro := fmt.Sprintf("Final Report:\nNumber of files processed: %d\n\n%s\n", len(s3Files), report.String())
 	ms := fmt.Sprintf("Honeygot Daily Report for %d-%d-%d", yr, int(mth), day)
 
 	t4 := time.Now()
@@ -116,37 +184,93 @@ func main() {
 }
 
 // produceReport creates a bytesBuffer with the text of the final report
-func produceReport(aeMap map[string]*AuthEvent) bytes.Buffer {
+func produceReport(aeMap map[string]*events.AuthEvent) bytes.Buffer {
 
 	var bB bytes.Buffer
 
 	srcIPMap := make(map[string]int)
+	srcNetMap := make(map[string]int)
+	countryMap := make(map[string]int)
+	asnMap := make(map[string]int)
 	destIPMap := make(map[string]int)
 	userMap := make(map[string]int)
 	pwMap := make(map[string]int)
 	authMap := make(map[string]int)
+	sessionMap := make(map[string]int)     // auth events in each session
+	methodOrderMap := make(map[string]int) // order ssh clients tried auth methods in
+	hasshMap := make(map[string]int)       // ssh connections from each client fingerprint
+	keyMap := make(map[string]int)         // ssh keys offered by fingerprint
+	authEvents := 0
 
 	for _, v := range aeMap {
 
+		switch v.AuthType {
+		case "connect":
+			sessionMap[v.SessionID] += 0
+			continue
+		case "disconnect":
+			continue
+		case "sshSummary":
+			if order := sshMethodOrder(v); order != "" {
+				methodOrderMap[order]++
+			}
+			if v.HASSH != "" {
+				hasshMap[v.HASSH]++
+			}
+			continue
+		}
+		authEvents++
+		if v.SessionID != "" {
+			sessionMap[v.SessionID]++
+		}
+
 		authMap[v.AuthType]++
+		if v.AuthType == "sshKey" {
+			if fp := keyFingerprint(v); fp != "" {
+				keyMap[fp]++
+			}
+		}
 		if v.AuthType != "sshPass" {
 			continue
 		}
 
 		// increment counters for each selection
 		srcIPMap[v.SrcIP]++
+		srcNetMap[sourceNetwork(v.SrcIP)]++
+		locate(v)
+		if v.Country != "" {
+			countryMap[v.Country]++
+		}
+		if v.ASN != 0 {
+			asnMap[fmt.Sprintf("AS%d %s", v.ASN, v.ASOrg)]++
+		}
 		destIPMap[v.DestIP]++
 		userMap[v.User]++
 		pwMap[v.Credentials]++
 	}
 
 	sortedsrsIP := rankByTopMax(srcIPMap, 25)
+	sortedsrcNet := rankByTopMax(srcNetMap, 25)
+	sortedCountries := rankByTopMax(countryMap, 25)
+	sortedASNs := rankByTopMax(asnMap, 25)
 	sorteddestIP := rankByTopMax(destIPMap, 25)
 	sortedUsers := rankByTopMax(userMap, 25)
 	sortedpwList := rankByTopMax(pwMap, 25)
 	sortedauth := rankByTopMax(authMap, 25)
+	sortedMethodOrders := rankByTopMax(methodOrderMap, 25)
+	sortedHASSH := rankByTopMax(hasshMap, 25)
+	sortedKeys := rankByTopMax(keyMap, 25)
 
-	bB.WriteString(fmt.Sprintf("Total auth events: %d\n\n", len(aeMap)))
+	bB.WriteString(fmt.Sprintf("Total auth events: %d\n\n", authEvents))
+
+	noAuth := 0
+	for _, n := range sessionMap {
+		if n == 0 {
+			noAuth++
+		}
+	}
+	bB.WriteString(fmt.Sprintf("Sessions:\nTotal sessions: %d\nWith auth attempts: %d\nWithout auth attempts: %d\n", len(sessionMap), len(sessionMap)-noAuth, noAuth))
+	bB.WriteString("========================\n\n")
 
 	bB.WriteString(fmt.Sprintf("Source IP address:\nTotal different IPs: %d\nTop 25 source addresses -\n", len(srcIPMap)))
 	bB.WriteString(fmt.Sprintf("Count\tSrc IP\n"))
@@ -155,6 +279,27 @@ func produceReport(aeMap map[string]*AuthEvent) bytes.Buffer {
 	}
 	bB.WriteString("========================\n\n")
 
+	bB.WriteString(fmt.Sprintf("Source networks (ipv6 grouped by /%d):\nTotal different networks: %d\nTop 25 source networks -\n", v6SourcePrefix, len(srcNetMap)))
+	bB.WriteString(fmt.Sprintf("Count\tSrc network\n"))
+	for _, v := range sortedsrcNet {
+		bB.WriteString(fmt.Sprintf("%v\t%v\n", v.Value, v.Key))
+	}
+	bB.WriteString("========================\n\n")
+
+	bB.WriteString(fmt.Sprintf("Source countries:\nTotal different countries: %d\nTop 25 source countries -\n", len(countryMap)))
+	bB.WriteString(fmt.Sprintf("Count\tCountry\n"))
+	for _, v := range sortedCountries {
+		bB.WriteString(fmt.Sprintf("%v\t%v\n", v.Value, v.Key))
+	}
+	bB.WriteString("========================\n\n")
+
+	bB.WriteString(fmt.Sprintf("Source ASNs:\nTotal different ASNs: %d\nTop 25 source ASNs -\n", len(asnMap)))
+	bB.WriteString(fmt.Sprintf("Count\tASN\n"))
+	for _, v := range sortedASNs {
+		bB.WriteString(fmt.Sprintf("%v\t%v\n", v.Value, v.Key))
+	}
+	bB.WriteString("========================\n\n")
+
 	bB.WriteString(fmt.Sprintf("Destination IP address:\nTotal different IPs: %d\nTop 25 destination addresses -\n", len(destIPMap)))
 	bB.WriteString(fmt.Sprintf("Count\tSrc IP\n"))
 	for _, v := range sorteddestIP {
@@ -183,16 +328,115 @@ func produceReport(aeMap map[string]*AuthEvent) bytes.Buffer {
 	}
 	bB.WriteString("========================\n\n")
 
+	bB.WriteString(fmt.Sprintf("SSH keys offered:\nTotal different keys: %d\nTop 25 key fingerprints -\n", len(keyMap)))
+	bB.WriteString(fmt.Sprintf("Count\tFingerprint\n"))
+	for _, v := range sortedKeys {
+		bB.WriteString(fmt.Sprintf("%v\t%v\n", v.Value, v.Key))
+	}
+	bB.WriteString("========================\n\n")
+
+	bB.WriteString(fmt.Sprintf("SSH client fingerprints (HASSH):\nTotal different fingerprints: %d\nTop 25 fingerprints -\n", len(hasshMap)))
+	bB.WriteString(fmt.Sprintf("Count\tHASSH\n"))
+	for _, v := range sortedHASSH {
+		bB.WriteString(fmt.Sprintf("%v\t%v\n", v.Value, v.Key))
+	}
+	bB.WriteString("========================\n\n")
+
+	bB.WriteString(fmt.Sprintf("SSH auth method orders:\nTotal different orders: %d\nTop 25 orders -\n", len(methodOrderMap)))
+	bB.WriteString(fmt.Sprintf("Count\tMethods\n"))
+	for _, v := range sortedMethodOrders {
+		bB.WriteString(fmt.Sprintf("%v\t%v\n", v.Value, v.Key))
+	}
+	bB.WriteString("========================\n\n")
+
 	return bB
 }
 
+// locate fills in the location of an event the sensor did not locate
+func locate(ae *events.AuthEvent) {
+	if geo == nil || ae.Country != "" || ae.ASN != 0 {
+		return
+	}
+	loc := geo.Lookup(ae.SrcIP)
+	ae.Country, ae.City, ae.ASN, ae.ASOrg = loc.Country, loc.City, loc.ASN, loc.ASOrg
+}
+
+// sshMethodOrder returns the auth methods an ssh client tried with repeats of the same
+// method collapsed, eg none,password. v2 events hold the attempts in their details and v1
+// events in TypeData
+func sshMethodOrder(ae *events.AuthEvent) string {
+
+	var methods []string
+	if raw, ok := ae.Details.(json.RawMessage); ok {
+		var d events.SSHSummaryDetails
+		if err := json.Unmarshal(raw, &d); err != nil {
+			return ""
+		}
+		for _, a := range d.Attempts {
+			methods = append(methods, a.Method)
+		}
+	} else if i := strings.Index(ae.TypeData, "methods: "); i >= 0 {
+		list := strings.Fields(ae.TypeData[i+len("methods: "):])
+		if len(list) > 0 && list[0] != "users:" {
+			methods = strings.Split(list[0], ",")
+		}
+	}
+
+	var order []string
+	for _, m := range methods {
+		if len(order) == 0 || order[len(order)-1] != m {
+			order = append(order, m)
+		}
+	}
+	return strings.Join(order, ",")
+}
+
+// keyFingerprint returns the openssh SHA256: fingerprint of the key offered in an sshKey
+// event. v2 events hold it in their details and v1 events in TypeData
+func keyFingerprint(ae *events.AuthEvent) string {
+
+	if raw, ok := ae.Details.(json.RawMessage); ok {
+		var d events.SSHDetails
+		if err := json.Unmarshal(raw, &d); err == nil && d.Fingerprint != "" {
+			return d.Fingerprint
+		}
+	}
+	if i := strings.Index(ae.TypeData, "fingerprint: "); i >= 0 {
+		if f := strings.Fields(ae.TypeData[i+len("fingerprint: "):]); len(f) > 0 {
+			return f[0]
+		}
+	}
+
+	// events from sensors that did not record the fingerprint only have the base64
+	// sha256 of the key as their credentials, which is the fingerprint with padding
+	if ae.Credentials != "" {
+		return "SHA256:" + strings.TrimRight(ae.Credentials, "=")
+	}
+	return ""
+}
+
+// v6SourcePrefix is the prefix length ipv6 sources are grouped by. A single ipv6 host
+// usually has a whole /64 to pick addresses from
+const v6SourcePrefix = 64
+
+// sourceNetwork returns the network a source address is ranked under. ipv4 addresses
+// are ranked on their own
+func sourceNetwork(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		return addr
+	}
+	n := net.IPNet{IP: ip.Mask(net.CIDRMask(v6SourcePrefix, 128)), Mask: net.CIDRMask(v6SourcePrefix, 128)}
+	return n.String()
+}
+
 // fillMap starts goroutines to download files from s3 and produce the map with all events
-func fillMap(s3svc *s3.S3, s3Files []*s3.Object) (map[string]*AuthEvent, error) {
+func fillMap(s3svc *s3.S3, s3Files []*s3.Object) (map[string]*events.AuthEvent, error) {
 	fileChan := make(chan string, maxRoutines)
-	resChan := make(chan *AuthEvent)
+	resChan := make(chan *events.AuthEvent)
 	doneChan := make(chan struct{})
 
-	tm := make(map[string]*AuthEvent)
+	tm := make(map[string]*events.AuthEvent)
 	var wg sync.WaitGroup
 
 	if debug == true {
@@ -244,7 +488,7 @@ func fillMap(s3svc *s3.S3, s3Files []*s3.Object) (map[string]*AuthEvent, error)
 
 // processS3File runs in a goroutine and reads filenames from the fileChan, pulls down the file, extracts the events
 // and then sends then on the resChan
-func processS3File(fileChan chan string, resChan chan *AuthEvent, wg *sync.WaitGroup) {
+func processS3File(fileChan chan string, resChan chan *events.AuthEvent, wg *sync.WaitGroup) {
 
 	defer wg.Done()
 
@@ -269,18 +513,30 @@ func processS3File(fileChan chan string, resChan chan *AuthEvent, wg *sync.WaitG
 		}
 
 		b.ReadFrom(getObjOutput.Body)
-		authEvents := bytes.Split(b.Bytes(), []byte("\n"))
+		getObjOutput.Body.Close()
+
+		data, err := batchCheck.check(s3FileName, b.Bytes())
+		if err == nil {
+			data, err = decodeBatch(data)
+		}
+		if err != nil {
+			fmt.Printf("unable to decode file: %s err: %v\n", s3FileName, err)
+			b.Reset()
+			continue
+		}
+		authEvents := bytes.Split(data, []byte("\n"))
 
 		for _, jsonae := range authEvents {
 			// last \n does not need unmarshal
 			if len(jsonae) < 10 {
 				continue
 			}
-			ae := &AuthEvent{}
-			err := json.Unmarshal(jsonae, &ae)
+			ae, err := events.Parse(jsonae)
 			if err != nil {
 				fmt.Printf("unmarshal fail:%v\n", err)
 				fmt.Printf("unmarshal json:\n%s\n", jsonae)
+			} else if err = ae.Validate(); err != nil {
+				fmt.Printf("invalid event in %s: %v\n", s3FileName, err)
 			} else {
 				resChan <- ae
 			}
@@ -290,8 +546,31 @@ func processS3File(fileChan chan string, resChan chan *AuthEvent, wg *sync.WaitG
 	}
 }
 
+// decodeBatch returns the json events in a batch. Older batches are plain json and newer
+// ones may be sealed and gzip compressed so the content is checked rather than the file name
+func decodeBatch(data []byte) ([]byte, error) {
+
+	if bytes.HasPrefix(data, []byte(sealMagic)) {
+		var err error
+		if data, err = openBatch(data); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return ioutil.ReadAll(zr)
+	}
+	return data, nil
+}
+
 // processResults runs in a goroutine and reads results from the workers and updates a global map
-func processResults(resChan chan *AuthEvent, doneChan chan struct{}, tm map[string]*AuthEvent) {
+func processResults(resChan chan *events.AuthEvent, doneChan chan struct{}, tm map[string]*events.AuthEvent) {
 
 	// read things from the resChan and add to the global map
 	for ae := range resChan {
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	sealMagic    = "HGBOX1" // starts every sealed batch. Must match honeygot
+	sealKeyBytes = 32       // size of a nacl box key
+)
+
+// sealPrivKey opens sealed batches. nil if no key was given
+var sealPrivKey *[32]byte
+
+// loadSealKey reads a hex encoded nacl box private key from a file
+func loadSealKey(path string) (*[32]byte, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(k) != sealKeyBytes {
+		return nil, fmt.Errorf("%s must hold a %d byte hex encoded key", path, sealKeyBytes)
+	}
+	var priv [32]byte
+	copy(priv[:], k)
+	return &priv, nil
+}
+
+// genSealKey prints a new key pair. The public key goes in the honeygot sink sealKey
+// and the private key in the file given to -sealkey
+func genSealKey() error {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("public key (honeygot sealKey): %x\nprivate key (report -sealkey file): %x\n", pub[:], priv[:])
+	return nil
+}
+
+// openBatch decrypts a batch sealed by honeygot.
+// The layout is sealMagic | ephemeral public key | nonce | nacl box of the data
+func openBatch(data []byte) ([]byte, error) {
+
+	if sealPrivKey == nil {
+		return nil, errors.New("batch is sealed and no -sealkey was given")
+	}
+
+	data = data[len(sealMagic):]
+	if len(data) < sealKeyBytes+24+box.Overhead {
+		return nil, errors.New("sealed batch is too short")
+	}
+
+	var pub [32]byte
+	var nonce [24]byte
+	copy(pub[:], data)
+	copy(nonce[:], data[sealKeyBytes:])
+
+	out, ok := box.Open(nil, data[sealKeyBytes+24:], &nonce, &pub, sealPrivKey)
+	if !ok {
+		return nil, errors.New("unable to open sealed batch. Wrong key?")
+	}
+	return out, nil
+}
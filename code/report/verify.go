@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	signMagic   = "HGSIG1"            // starts every signed batch. Must match honeygot
+	signVersion = "honeygot-batch-v1" // first line of the signed message
+)
+
+// sigHeader is stored in front of a signed batch. Must match honeygot
+type sigHeader struct {
+	Chain string `json:"chain"`
+	Seq   uint64 `json:"seq"`
+	Prev  string `json:"prev"`
+	Hash  string `json:"hash"`
+	Key   string `json:"key"`
+	Sig   string `json:"sig"`
+}
+
+// chainLink is a signed batch as seen by the report
+type chainLink struct {
+	file string // s3 key of the batch
+	seq  uint64
+	prev string // hash of the previous batch named by this one
+	hash string // hash of this whole batch
+}
+
+// integrity collects what was found checking batch signatures while the files are read
+type integrity struct {
+	mu       sync.Mutex
+	sensors  map[string]string // trusted public keys by sensor id. nil trusts any key
+	unsigned int
+	problems []string
+	chains   map[string][]chainLink
+}
+
+var batchCheck = &integrity{chains: make(map[string][]chainLink)}
+
+// loadSensorKeys reads the trusted sensor keys, one "sensor hexkey" pair per line
+func loadSensorKeys(path string) (map[string]string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: expected sensor and key on line %q", path, sc.Text())
+		}
+		keys[fields[0]] = fields[1]
+	}
+	return keys, sc.Err()
+}
+
+// check verifies a batch if it is signed and records it in its chain. It returns the
+// batch with the signature removed
+func (c *integrity) check(file string, data []byte) ([]byte, error) {
+
+	if !bytes.HasPrefix(data, []byte(signMagic)) {
+		c.mu.Lock()
+		c.unsigned++
+		c.mu.Unlock()
+		return data, nil
+	}
+
+	h, payload, err := splitSigned(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if problem := c.verify(h, payload); problem != "" {
+		c.mu.Lock()
+		c.problems = append(c.problems, fmt.Sprintf("%s: %s", file, problem))
+		c.mu.Unlock()
+	}
+
+	sum := sha256.Sum256(data)
+	c.mu.Lock()
+	c.chains[h.Chain] = append(c.chains[h.Chain], chainLink{file: file, seq: h.Seq, prev: h.Prev, hash: hex.EncodeToString(sum[:])})
+	c.mu.Unlock()
+
+	return payload, nil
+}
+
+// splitSigned separates the header from the payload of a signed batch
+func splitSigned(data []byte) (*sigHeader, []byte, error) {
+
+	data = data[len(signMagic):]
+	if len(data) < 4 {
+		return nil, nil, errors.New("signed batch is too short")
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint64(len(data)-4) < uint64(n) {
+		return nil, nil, errors.New("signed batch header is too short")
+	}
+
+	h := &sigHeader{}
+	if err := json.Unmarshal(data[4:4+n], h); err != nil {
+		return nil, nil, err
+	}
+	return h, data[4+n:], nil
+}
+
+// verify returns a description of what is wrong with a signed batch, or "" if it is good
+func (c *integrity) verify(h *sigHeader, payload []byte) string {
+
+	sum := sha256.Sum256(payload)
+	if hex.EncodeToString(sum[:]) != h.Hash {
+		return "payload does not match its hash"
+	}
+
+	pub, err := hex.DecodeString(h.Key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return "invalid public key"
+	}
+	sig, err := hex.DecodeString(h.Sig)
+	if err != nil {
+		return "invalid signature"
+	}
+
+	msg := fmt.Sprintf("%s\n%s\n%d\n%s\n%s", signVersion, h.Chain, h.Seq, h.Prev, h.Hash)
+	if !ed25519.Verify(ed25519.PublicKey(pub), []byte(msg), sig) {
+		return "bad signature"
+	}
+
+	if c.sensors != nil {
+		sensor := strings.SplitN(h.Chain, "/", 2)[0]
+		if want, ok := c.sensors[sensor]; !ok {
+			return fmt.Sprintf("sensor %s has no trusted key", sensor)
+		} else if want != h.Key {
+			return fmt.Sprintf("sensor %s signed with untrusted key %s", sensor, h.Key)
+		}
+	}
+	return ""
+}
+
+// chainProblems walks every chain in sequence order looking for forks, gaps and broken links.
+// The first batch read for a chain can not be linked as its parent was in an earlier report
+func (c *integrity) chainProblems() []string {
+
+	var problems []string
+	for name, links := range c.chains {
+
+		sort.Slice(links, func(i, j int) bool { return links[i].seq < links[j].seq })
+
+		for i := 1; i < len(links); i++ {
+			prev, cur := links[i-1], links[i]
+			switch {
+			case cur.seq == prev.seq:
+				problems = append(problems, fmt.Sprintf("%s: fork at batch %d - %s and %s", name, cur.seq, prev.file, cur.file))
+			case cur.seq == prev.seq+2:
+				problems = append(problems, fmt.Sprintf("%s: batch %d missing", name, prev.seq+1))
+			case cur.seq > prev.seq+2:
+				problems = append(problems, fmt.Sprintf("%s: batches %d to %d missing", name, prev.seq+1, cur.seq-1))
+			case cur.prev != prev.hash:
+				problems = append(problems, fmt.Sprintf("%s: batch %d (%s) does not follow batch %d", name, cur.seq, cur.file, prev.seq))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// report returns the batch integrity section of the report
+func (c *integrity) report() string {
+
+	var bB bytes.Buffer
+
+	signed := 0
+	for _, links := range c.chains {
+		signed += len(links)
+	}
+
+	bB.WriteString(fmt.Sprintf("Batch integrity:\nSigned batches: %d\nUnsigned batches: %d\nChains: %d\n", signed, c.unsigned, len(c.chains)))
+
+	problems := append(append([]string(nil), c.problems...), c.chainProblems()...)
+	if len(problems) == 0 {
+		bB.WriteString("No problems found\n")
+	} else {
+		bB.WriteString(fmt.Sprintf("Problems found: %d\n", len(problems)))
+		for _, p := range problems {
+			bB.WriteString(p + "\n")
+		}
+	}
+	bB.WriteString("========================\n\n")
+	return bB.String()
+}